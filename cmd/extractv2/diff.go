@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cmdUtils "pcap-go/pkg/cmd-utils"
+	"pcap-go/pkg/haiku"
+	"pcap-go/pkg/lib"
+)
+
+const diffUsage = `Usage: extractv2 diff [-precision d] [-wrap n] [-dict name] [-ratio r] [-min n] before after
+
+before and after are captures (files, globs or directories) or -F summaries
+written with -format json or ndjson, -stack ones being reduced to haikus. The fingerprints which are new, gone or
+whose packet count changed by at least -ratio are shown on stderr, the new
+ones are printed on stdout, ready for nfqueue -black.
+
+Examples:
+  extractv2 diff round-41/ round-42/
+  extractv2 -F -format json round-41.pcap > 41.json
+  nfqueue -black $(extractv2 diff 41.json round-42.pcap)
+`
+
+// fingerprintCounts returns the packets per fingerprint of a capture or summary
+func fingerprintCounts(arg string) (map[string]int, error) {
+	if summary, err := readSummary(arg); err == nil {
+		return summary, nil
+	}
+
+	paths, err := lib.ExpandCaptures([]string{arg})
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := lib.OpenMergedSource(paths)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	// the same estimates as the main command, fresh for each input
+	annotator := lib.NewAnnotator()
+	counts := make(map[string]int)
+	packets := lib.NewPacketSource(source)
+	for {
+		packet, err := packets.NextPacket()
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			cmdUtils.LogError("malformed packet: ", err)
+			continue
+		}
+
+		fp, err := annotate(annotator, packet)
+		if err != nil {
+			continue
+		}
+		counts[fp.Haiku()]++
+	}
+}
+
+// readSummary reads the counts of a json or ndjson output of extractv2
+func readSummary(path string) (map[string]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == '[' || c == '{' {
+			reader.UnreadByte()
+			break
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(c)) {
+			return nil, errors.New("not a json summary")
+		}
+	}
+
+	var recs []cmdUtils.Record
+	dec := json.NewDecoder(reader)
+	for {
+		var batch []cmdUtils.Record
+
+		// a json array or a stream of ndjson objects
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(string(raw), "[") {
+			err = json.Unmarshal(raw, &batch)
+		} else {
+			batch = make([]cmdUtils.Record, 1)
+			err = json.Unmarshal(raw, &batch[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, batch...)
+	}
+
+	// -F totals if there are any, the packets otherwise. The stack signature
+	// of -stack keys is dropped, nfqueue only takes haikus.
+	frequencies, packets := make(map[string]int), make(map[string]int)
+	snapshot := ""
+	for _, rec := range recs {
+		key, _, _ := strings.Cut(rec.Haiku, "/")
+		switch rec.Type {
+		case cmdUtils.RecordFrequency:
+			// live captures write the totals on every refresh, the last
+			// snapshot is the complete one
+			if rec.Snapshot != snapshot {
+				frequencies, snapshot = make(map[string]int), rec.Snapshot
+			}
+			frequencies[key] += rec.Count
+		case cmdUtils.RecordPacket:
+			packets[key]++
+		}
+	}
+
+	if len(frequencies) > 0 {
+		return frequencies, nil
+	}
+	return packets, nil
+}
+
+type fingerprintChange struct {
+	key           string
+	before, after int
+}
+
+// delta returns by how many packets the count changed
+func (c fingerprintChange) delta() int {
+	return max(c.after-c.before, c.before-c.after)
+}
+
+func (c fingerprintChange) String() string {
+	return fmt.Sprintf("%s: %d -> %d", c.key, c.before, c.after)
+}
+
+// diffCounts splits the fingerprints into new, gone and changed by at least ratio
+func diffCounts(before, after map[string]int, ratio float64, minPackets int) (added, gone, changed []fingerprintChange) {
+	for key, n := range after {
+		if before[key] == 0 {
+			if n >= minPackets {
+				added = append(added, fingerprintChange{key, 0, n})
+			}
+			continue
+		}
+
+		lo, hi := float64(min(n, before[key])), float64(max(n, before[key]))
+		if hi/lo >= ratio && max(n, before[key]) >= minPackets {
+			changed = append(changed, fingerprintChange{key, before[key], n})
+		}
+	}
+
+	for key, n := range before {
+		if after[key] == 0 && n >= minPackets {
+			gone = append(gone, fingerprintChange{key, n, 0})
+		}
+	}
+
+	// busiest first
+	for _, changes := range [][]fingerprintChange{added, gone, changed} {
+		sort.Slice(changes, func(i, j int) bool {
+			di, dj := changes[i].delta(), changes[j].delta()
+			if di != dj {
+				return di > dj
+			}
+			return changes[i].key < changes[j].key
+		})
+	}
+	return
+}
+
+// runDiff compares the fingerprints of two captures, invoked as "extractv2 diff ..."
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	precision := fs.Duration("precision", time.Duration(lib.DefaultConfig.Precision)*time.Millisecond, "width of the fingerprint buckets")
+	wrapBits := fs.Uint("wrap", lib.DefaultConfig.Bits, "fingerprints wrap around at 2^wrap buckets")
+	dictionary := fs.String("dict", lib.DefaultConfig.Dictionary, "word list of the haikus, built-in ("+strings.Join(haiku.Dictionaries(), ", ")+") or a file with a word per line")
+	ratio := fs.Float64("ratio", 2, "show the fingerprints whose packet count changed by at least this factor")
+	minPackets := fs.Int("min", 1, "ignore the fingerprints with fewer packets on both sides")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, diffUsage) }
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err := lib.SetConfig(lib.Config{Precision: uint64(precision.Milliseconds()), Bits: *wrapBits, Dictionary: *dictionary})
+	if err != nil {
+		cmdUtils.LogFatalError("invalid fingerprint settings: ", err)
+	}
+
+	var counts [2]map[string]int
+	for i := range counts {
+		if counts[i], err = fingerprintCounts(fs.Arg(i)); err != nil {
+			cmdUtils.LogFatalError("failed to read "+fs.Arg(i)+": ", err)
+		}
+	}
+
+	added, gone, changed := diffCounts(counts[0], counts[1], *ratio, *minPackets)
+
+	for _, section := range []struct {
+		title   string
+		changes []fingerprintChange
+	}{{"New", added}, {"Gone", gone}, {"Changed", changed}} {
+		fmt.Fprintf(os.Stderr, "%s (%d)\n", section.title, len(section.changes))
+		for _, change := range section.changes {
+			fmt.Fprintf(os.Stderr, "\t%s\n", change)
+		}
+		fmt.Fprintln(os.Stderr, "")
+	}
+
+	keys := make([]string, 0, len(added))
+	for _, change := range added {
+		keys = append(keys, change.key)
+	}
+	fmt.Println(strings.Join(keys, ","))
+}
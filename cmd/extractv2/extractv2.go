@@ -10,84 +10,181 @@ import (
 	"os/signal"
 	cmdUtils "pcap-go/pkg/cmd-utils"
 	"pcap-go/pkg/lib"
+	"pcap-go/pkg/haiku"
 	"regexp"
+	"runtime"
 	"sync"
 	"time"
     "strings"
     "sort"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/layers"
 )
 
 var startTime time.Time
 
-var fgCollected = make([]lib.Fingerprint, 0)
+var fgCollected = make([]string, 0)
 var fgFrequency sync.Map
+var fgModes sync.Map
 
-var sink *pcapgo.Writer
+var sink lib.PacketSink
 
-//sync
-var fgMutex sync.Mutex
-var wg sync.WaitGroup
+// machine-readable output, nil for the default text format
+var records cmdUtils.RecordWriter
 
-var fgsToMatch []string
-var fgsToUnmatch []string
+var annotator = lib.NewAnnotator()
+
+var fgsToMatch *lib.FingerprintSet
+var fgsToUnmatch *lib.FingerprintSet
+
+var fgTimeline *timeline
+
+// guards the output and the -L/-F state, written by the emitter and read by
+// the live refresh
+var outputMutex sync.Mutex
+
+// time of the summaries being written: live captures write them on every
+// refresh, and their records tell the snapshots apart with it
+var snapshotTime string
+
+// annotatedFingerprint fingerprints the packet and runs the estimators on it,
+// packets must come in capture order
+func annotatedFingerprint(packet gopacket.Packet) (lib.Fingerprint, error) {
+	return annotate(annotator, packet)
+}
+
+// annotate fingerprints the packet with the given estimators
+func annotate(a *lib.Annotator, packet gopacket.Packet) (lib.Fingerprint, error) {
+	fp, millis, tsVal, err := lib.ExtractFingerprint(packet)
+	if err != nil {
+		return fp, err
+	}
+
+    a.Annotate(packet, &fp, millis, tsVal)
+    return fp, nil
+}
+
+// passesFilters applies -white and -black
+func passesFilters(fp lib.Fingerprint) bool {
+	return !((*fingerprintToMatch != "" && !fgsToMatch.Contains(fp)) || (*fingerprintToUnmatch != "" && fgsToUnmatch.Contains(fp)))
+}
+
+// fingerprintPacket runs in the worker pool: it decodes a packet, extracts
+// its fingerprint and applies the filters which don't depend on the
+// estimators
+func fingerprintPacket(job matchedPacket) (res matchedPacket) {
+	packet := lib.DecodePacket(job.data, job.ci)
+	res.packet = packet
 
-func processPacket(packet gopacket.Packet) {
-    wg.Add(1)
-    defer wg.Done()
 	tcpLayer := packet.Layer(layers.LayerTypeTCP)
 	if tcpLayer == nil { // skip non-TCP packets
 		return
 	}
 
-	fp, _, _, err := lib.ExtractFingerprint(packet)
+	var err error
+	res.fp, res.millis, res.tsVal, err = lib.ExtractFingerprint(packet)
 	if err != nil {
 		return
 	}
+	res.hasFp = true
 
-	// if a fingerprint is provided, only show packets that match
-	if (*fingerprintToMatch != "" && !fp.ContainedIn(fgsToMatch)) || (*fingerprintToUnmatch != "" && fp.ContainedIn(fgsToUnmatch)) {
-		return
-	}
-    
 	body := tcpLayer.LayerPayload()
     // if a regex is provided, only show packets that match
 	if regex != nil && !regex.Match(body) {
 		return
 	}
 
-    fgMutex.Lock()
+    // in stack mode only SYNs are considered, keyed by the composite fingerprint
+    if *stackMode {
+        sig, err := lib.StackSignatureOf(packet)
+        if err != nil {
+            return
+        }
+        res.stack = sig
+    }
+
+    res.matched = true
+    return
+}
+
+// emitPacket is called in capture order with the outcome of
+// fingerprintPacket: it runs the estimators, which depend on the packet
+// order, then applies -white and -black and shows the packet
+func emitPacket(res matchedPacket) {
+    if !res.hasFp {
+        return
+    }
+
+    // every fingerprinted packet feeds the estimators, even if filtered out
+    fp := res.fp
+    annotator.Annotate(res.packet, &fp, res.millis, res.tsVal)
+
+    // if a fingerprint is provided, only show packets that match
+    if !res.matched || !passesFilters(fp) {
+        return
+    }
+
+    // in stack mode fingerprints are keyed by the composite fingerprint
+    packet, key := res.packet, fp.Haiku()
+    if *stackMode {
+        key = lib.CompositeFingerprint{Fingerprint: fp, Stack: res.stack}.String()
+    }
+
+    outputMutex.Lock()
+    defer outputMutex.Unlock()
+
     if *outputPcap != "" {
-		sink.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+		comment := fmt.Sprintf("%s Delta=%d", key, fp.Delta)
+		if fp.Skewed {
+			comment = fmt.Sprintf("%s Skew=%+.0fppm", key, fp.Skew)
+		}
+		if err := sink.WritePacket(packet, comment); err != nil {
+			cmdUtils.LogError("failed to write packet: ", err)
+		}
     }
 
-    if *listMode {
+    collectFingerprint(key, fp.Mode, packet.Metadata().Timestamp)
 
+    if records != nil {
+        writeRecord(cmdUtils.NewPacketRecord(packet, fp, key))
+        return
+    }
 
+	// count the number of non-printable characters
+	// if it is too high, we just show the number of bytes
+	cmdUtils.ShowBodyInfo(packet, fp, *displayData)
+}
+
+// collectFingerprint feeds -L, -F and -timeline
+func collectFingerprint(key string, mode string, ts time.Time) {
+    if *listMode {
         exists := false
         for _, collected := range fgCollected {
-            if collected.Delta == fp.Delta {
+            if collected == key {
                 exists = true
                 break
             }
         }
         if !exists {
-            fgCollected = append(fgCollected, fp)
+            fgCollected = append(fgCollected, key)
         }
-
     }
-    fgMutex.Unlock()
 
     if *frequencyMode {
-        incrementSyncMapValue(&fgFrequency, fp.Haiku(), 1)
+        incrementSyncMapValue(&fgFrequency, key, 1)
+        fgModes.Store(key, mode)
     }
 
+    if *timelineSlot > 0 {
+        fgTimeline.add(key, ts)
+    }
+}
 
-	// count the number of non-printable characters
-	// if it is too high, we just show the number of bytes
-	cmdUtils.ShowBodyInfo(packet, fp, *displayData)
+func writeRecord(rec cmdUtils.Record) {
+    if err := records.Write(rec); err != nil {
+        cmdUtils.LogFatalError("failed to write output: ", err)
+    }
 }
 
 func incrementSyncMapValue(m *sync.Map, key string, delta int) {
@@ -121,11 +218,31 @@ var (
 	frequencyMode      = flag.Bool("F", false, "suppress regular output, list fingerprints and their frequency")
 	displayData        = flag.Bool("data", false, "display data")
     outputPcap         = flag.String("o", "", "write the matched pkgs to this pcap")
+	outputNg           = flag.Bool("pcapng", false, "write -o as pcapng, with each packet's fingerprint as comment (default for .pcapng files)")
 	fingerprintToMatch = flag.String("white", "", "fingerprints to match")
 	fingerprintToUnmatch = flag.String("black", "", "fingerprints to not match (it has priority over the whitelist)")
+	precision          = flag.Duration("precision", 10*time.Second, "width of the fingerprint buckets")
+	wrapBits           = flag.Uint("wrap", 18, "fingerprints wrap around at 2^wrap buckets")
+	dictionary         = flag.String("dict", "haiku", "word list of the haikus, built-in ("+strings.Join(haiku.Dictionaries(), ", ")+") or a file with a word per line")
+	tolerance          = flag.Uint64("tolerance", 0, "also match fingerprints up to N buckets away from a listed one")
 	showProgress       = flag.Bool("p", false, "show progress")
+	workers            = flag.Int("j", runtime.NumCPU(), "number of workers decoding and fingerprinting packets, the estimators still see them in capture order")
 	regexStr           = flag.String("r", "", "regex to match")
 	bpfStr             = flag.String("bpf", "", "BPF filter")
+	liveIface          = flag.String("i", "", "capture live from this interface instead of reading a pcap")
+	timelineSlot       = flag.Duration("timeline", 0, "show the packets of each fingerprint over time, in slots of this duration (e.g. 1m)")
+	sinceStr           = flag.String("since", "", "only consider packets captured from this time on: RFC3339 or a duration before now, e.g. 5m")
+	untilStr           = flag.String("until", "", "only consider packets captured before this time: RFC3339 or a duration before now")
+	roundStartStr      = flag.String("round-start", "", "RFC3339 start time of round 0, for -round")
+	roundDuration      = flag.Duration("round-duration", 0, "duration of a round (CTF tick), for -round")
+	round              = flag.Int("round", -1, "only consider packets captured during this round")
+	follow             = flag.Bool("follow", false, "watch the given directories and process new rotated captures as they appear")
+	snaplen            = flag.Int("snaplen", 65536, "snapshot length of live captures")
+	promisc            = flag.Bool("promisc", true, "put the interface in promiscuous mode")
+	refreshEvery       = flag.Duration("refresh", 10*time.Second, "how often live captures show progress and the -L/-F summaries")
+	outputFormat       = flag.String("format", "text", "output format: text, json, ndjson or csv (structured output goes to stdout)")
+	streamMode         = flag.Bool("stream", false, "reassemble TCP connections, match -r on the streams and show the conversations")
+	stackMode          = flag.Bool("stack", false, "only consider client SYNs, list fingerprints combined with the TCP/IP stack signature")
 	regex              *regexp.Regexp
 )
 
@@ -136,11 +253,47 @@ func safeCloseIO(file *os.File) {
 	}
 }
 
+// refreshSummaries shows progress and the -L/-F/-timeline summaries of a live capture
+func refreshSummaries(packetCount uint64) {
+    outputMutex.Lock()
+    defer outputMutex.Unlock()
+
+    if records == nil {
+        fmt.Fprintf(os.Stderr, "\n--- %s ---\n", time.Now().Format(time.TimeOnly))
+    }
+    takeSnapshot()
+
+    if *showProgress {
+        cmdUtils.PrintProgress(startTime, packetCount, 1)
+    }
+    if *listMode {
+        listEpilogue()
+    }
+    if *frequencyMode {
+        frequencyEpilogue()
+    }
+    if *timelineSlot > 0 {
+        timelineEpilogue()
+    }
+}
+
+// takeSnapshot starts a new set of summaries
+func takeSnapshot() {
+    snapshotTime = time.Now().Format(time.RFC3339Nano)
+}
+
 func listEpilogue() {
     sort.Slice(fgCollected, func(i, j int) bool {
-        return fgCollected[i].Haiku() < fgCollected[j].Haiku()
+        return fgCollected[i] < fgCollected[j]
     })
 
+    if records != nil {
+        for _, fg := range fgCollected {
+            writeRecord(cmdUtils.Record{Type: cmdUtils.RecordFingerprint, Haiku: fg, Snapshot: snapshotTime})
+        }
+        return
+    }
+
     fmt.Fprintln(os.Stderr, "Collected", len(fgCollected), "fingerprints")
     for i, fg := range fgCollected {
         if i < len(fgCollected)-1 {
@@ -156,6 +309,7 @@ func listEpilogue() {
 type FgFreq struct {
     Key   string
     Value int
+    Mode  string
 }
 func frequencyEpilogue() {
     var kvSlice []FgFreq
@@ -166,7 +320,9 @@ func frequencyEpilogue() {
         strKey, okKey := key.(string)
         intValue, okValue := value.(int)
         if okKey && okValue {
-            kvSlice = append(kvSlice, FgFreq{Key: strKey, Value: intValue})
+            mode, _ := fgModes.Load(strKey)
+            strMode, _ := mode.(string)
+            kvSlice = append(kvSlice, FgFreq{Key: strKey, Value: intValue, Mode: strMode})
         }
         return true // Continue the iteration
     })
@@ -176,11 +332,22 @@ func frequencyEpilogue() {
         return kvSlice[i].Value < kvSlice[j].Value
     })
 
+    if records != nil {
+        for _, kv := range kvSlice {
+            writeRecord(cmdUtils.Record{Type: cmdUtils.RecordFrequency, Haiku: kv.Key, Mode: kv.Mode, Count: kv.Value, Snapshot: snapshotTime})
+        }
+        return
+    }
+
     fmt.Fprintln(os.Stderr, "")
 
     //print sorted
     for _, kv := range kvSlice {
-        fmt.Fprintf(os.Stderr, "%s: %d\n", kv.Key, kv.Value)
+        mode := kv.Mode
+        if mode == lib.ModeUnknown {
+            mode = "unknown"
+        }
+        fmt.Fprintf(os.Stderr, "%s: %d (%s)\n", kv.Key, kv.Value, mode)
     }
 
     fmt.Fprintln(os.Stderr, "")
@@ -199,10 +366,26 @@ func frequencyEpilogue() {
 func main() {
 	var err error
 
+    if len(os.Args) > 1 && os.Args[1] == "diff" {
+        runDiff(os.Args[2:])
+        return
+    }
+
 	flag.Parse()
 
-    fgsToMatch = strings.Split(*fingerprintToMatch, ",")
-    fgsToUnmatch = strings.Split(*fingerprintToUnmatch, ",")
+    err = lib.SetConfig(lib.Config{Precision: uint64(precision.Milliseconds()), Bits: *wrapBits, Dictionary: *dictionary})
+    if err != nil {
+        cmdUtils.LogFatalError("invalid fingerprint settings: ", err)
+    }
+
+    fgsToMatch, err = lib.ParseFingerprintSet(strings.Split(*fingerprintToMatch, ","), *tolerance)
+    if err != nil {
+        cmdUtils.LogFatalError("invalid fingerprint: ", err)
+    }
+    fgsToUnmatch, err = lib.ParseFingerprintSet(strings.Split(*fingerprintToUnmatch, ","), *tolerance)
+    if err != nil {
+        cmdUtils.LogFatalError("invalid fingerprint: ", err)
+    }
 
 	if *regexStr != "" {
 		regex, err = regexp.Compile(*regexStr)
@@ -211,8 +394,12 @@ func main() {
 		}
 	}
 
-	if len(flag.Args()) != 1 {
-        cmdUtils.LogFatalError("Usage : euriclea {input.pcap}", errors.New("") )
+    if *streamMode && (*outputPcap != "" || *stackMode) {
+        cmdUtils.LogFatalError("", errors.New("-stream can't be combined with -o or -stack"))
+    }
+
+	if (*liveIface == "") == (len(flag.Args()) == 0) {
+        cmdUtils.LogFatalError("Usage : euriclea {input.pcap | dir | glob}... | -follow {dir}... | -i {iface}", errors.New("") )
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -221,29 +408,90 @@ func main() {
 		cancel()
 	}()
 
-    source, reader, err := lib.OpenPcapSource(flag.Arg(0))
-    defer safeCloseIO(reader)
+    var source lib.PacketReader
+    if *liveIface != "" {
+        live, err := lib.OpenLiveSource(*liveIface, int32(*snaplen), *promisc)
+        if err != nil {
+            cmdUtils.LogFatalError("Failed to open live capture ", err)
+        }
+        defer live.Close()
+        source = live
+    } else if *follow {
+        followed, err := lib.NewFollowSource(flag.Args())
+        if err != nil {
+            cmdUtils.LogFatalError("Failed to follow captures ", err)
+        }
+        defer followed.Close()
+        source = followed
+    } else if flag.NArg() == 1 && flag.Arg(0) == "-" {
+        var reader *os.File
+        source, reader, err = lib.OpenPcapSource(flag.Arg(0))
+        defer safeCloseIO(reader)
 
-    if err != nil {
-        cmdUtils.LogFatalError("Failed to open pcap source", err)
+        if err != nil {
+            cmdUtils.LogFatalError("Failed to open pcap source", err)
+        }
+    } else {
+        paths, err := lib.ExpandCaptures(flag.Args())
+        if err != nil {
+            cmdUtils.LogFatalError("Failed to open pcap source", err)
+        }
+
+        merged, err := lib.OpenMergedSource(paths)
+        if err != nil {
+            cmdUtils.LogFatalError("Failed to open pcap source", err)
+        }
+        defer merged.Close()
+        source = merged
     }
 
-	err = source.SetBPFFilter(*bpfStr)
+	source, err = lib.FilterSource(source, *bpfStr)
 	if err != nil {
         cmdUtils.LogFatalError("failed to set BPF filter: ", err)
 	}
 
+    // packets out of the time window are dropped before being decoded
+    since, until, err := timeWindow(time.Now())
+    if err != nil {
+        cmdUtils.LogFatalError("invalid time window: ", err)
+    }
+    source = lib.FilterTime(source, since, until)
+
     if *outputPcap != "" {
         var writer *os.File
-        sink, writer, err = lib.OpenPcapSink(*outputPcap)
+        ng := *outputNg || strings.HasSuffix(*outputPcap, ".pcapng")
+        sink, writer, err = lib.OpenPcapSink(*outputPcap, ng, lib.SinkLinkType(source))
         defer safeCloseIO(writer)
 
         if err != nil {
             cmdUtils.LogFatalError("Failed to open pcap sink ", err)
         }
+
+        defer func() {
+            if err := sink.Flush(); err != nil {
+                cmdUtils.LogError("failed to write pcap sink: ", err)
+            }
+        }()
     }
 
-	handle := gopacket.NewPacketSource(source, source.LinkType())
+    if *outputFormat != "text" {
+        if *outputPcap == "-" {
+            cmdUtils.LogFatalError("", errors.New("-format and -o - would both write to stdout"))
+        }
+
+        records, err = cmdUtils.NewRecordWriter(*outputFormat, os.Stdout)
+        if err != nil {
+            cmdUtils.LogFatalError("invalid output format: ", err)
+        }
+
+        defer func() {
+            if err := records.Close(); err != nil {
+                cmdUtils.LogFatalError("failed to write output: ", err)
+            }
+        }()
+    }
+
+	handle := lib.NewPacketSource(source)
 
 	packetCount := uint64(0)
 
@@ -255,27 +503,58 @@ func main() {
         defer frequencyEpilogue()
     }
 
+    if *timelineSlot > 0 {
+        fgTimeline = newTimeline(*timelineSlot)
+        defer timelineEpilogue()
+    }
+
+    // runs first, the summaries at exit are the last snapshot
+    defer takeSnapshot()
+
+	pool := newWorkerPool(*workers, fingerprintPacket, emitPacket)
+	streams := newStreamReassembler()
+
+    // streams are reassembled on this goroutine, packets go through the pool
+    closeAll := func() {
+        pool.Close()
+        streams.Close()
+    }
+
 	startTime = time.Now()
+    lastRefresh := startTime
 	for {
 		select {
 		case <-ctx.Done():
-            wg.Wait()
+            closeAll()
 			return
 		default:
 		}
 
-		packet, err := handle.NextPacket()
+        // live captures never end, show the summaries periodically instead
+        if (*liveIface != "" || *follow) && time.Since(lastRefresh) >= *refreshEvery {
+            lastRefresh = time.Now()
+            refreshSummaries(packetCount)
+        }
+
+		// packets are decoded by the pool, streams on this goroutine
+		data, ci, err := handle.NextPacketData()
 		if err != nil {
 			if err == io.EOF {
 				cancel()
 				break
-			} else {
+			} else if err == pcap.NextErrorTimeoutExpired {
+                continue
+            } else {
                 cmdUtils.LogError("malformed packet: ", err)
                 continue
             }
 		}
 
-		go processPacket(packet)
+        if *streamMode {
+            streams.Feed(lib.DecodePacket(data, ci))
+        } else {
+            pool.Submit(matchedPacket{data: data, ci: ci})
+        }
 
 		packetCount++
         if *showProgress {
@@ -285,7 +564,7 @@ func main() {
 
 	// wait for the context to be done
 	<-ctx.Done()
-    wg.Wait()
+    closeAll()
 
     if *showProgress {
 	    cmdUtils.PrintProgress(startTime, packetCount, 1)
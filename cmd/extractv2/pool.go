@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/gopacket"
+	"pcap-go/pkg/lib"
+)
+
+// packets in flight per worker, bounds the reorder buffer and thus memory
+const reorderWindow = 64
+
+// matchedPacket is a packet read in capture order, decoded, fingerprinted
+// and matched against the regex by the pool, then annotated and filtered by
+// fingerprint in capture order
+type matchedPacket struct {
+	seq  uint64
+	data []byte
+	ci   gopacket.CaptureInfo
+
+	packet        gopacket.Packet
+	fp            lib.Fingerprint
+	millis, tsVal uint64 // capture time and raw TSval, for the estimators
+	hasFp         bool
+	matched       bool               // by the regex and, with -stack, as a client SYN
+	stack         lib.StackSignature // with -stack
+}
+
+// workerPool processes packets in parallel and hands the results to emit one
+// at a time, in the order they were submitted
+type workerPool struct {
+	jobs    chan matchedPacket
+	results chan matchedPacket
+	window  chan struct{}
+	done    chan struct{}
+	seq     uint64
+}
+
+func newWorkerPool(workers int, process func(matchedPacket) matchedPacket, emit func(matchedPacket)) *workerPool {
+	workers = max(workers, 1)
+
+	p := &workerPool{
+		jobs:    make(chan matchedPacket, workers),
+		results: make(chan matchedPacket, workers),
+		window:  make(chan struct{}, workers*reorderWindow),
+		done:    make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range p.jobs {
+				res := process(job)
+				res.seq = job.seq
+				p.results <- res
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(p.results)
+	}()
+
+	// reorder buffer: results are held until all the previous ones are out
+	go func() {
+		defer close(p.done)
+
+		pending := make(map[uint64]matchedPacket)
+		next := uint64(0)
+
+		for res := range p.results {
+			pending[res.seq] = res
+			for {
+				res, found := pending[next]
+				if !found {
+					break
+				}
+				delete(pending, next)
+				emit(res)
+				next++
+				<-p.window
+			}
+		}
+	}()
+
+	return p
+}
+
+// Submit queues a packet, blocking while the window of packets in flight is
+// full
+func (p *workerPool) Submit(job matchedPacket) {
+	p.window <- struct{}{}
+	job.seq = p.seq
+	p.jobs <- job
+	p.seq++
+}
+
+// Close waits for all the submitted packets to be emitted
+func (p *workerPool) Close() {
+	close(p.jobs)
+	<-p.done
+}
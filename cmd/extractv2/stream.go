@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	cmdUtils "pcap-go/pkg/cmd-utils"
+	"pcap-go/pkg/lib"
+)
+
+const (
+	// Bytes kept per direction of a connection, the rest is dropped
+	maxStreamBytes = 1 << 20
+	// Connections idle for longer than this (capture time) are closed
+	streamTimeout = 2 * time.Minute
+	// Packets between two flushes of the idle connections
+	streamFlushEvery = 10_000
+	// Bytes of each segment shown without -data
+	segmentPreview = 256
+)
+
+// streamContext hands the packet's fingerprint over to the stream
+type streamContext struct {
+	ci    gopacket.CaptureInfo
+	fp    lib.Fingerprint
+	hasFp bool
+}
+
+func (c *streamContext) GetCaptureInfo() gopacket.CaptureInfo { return c.ci }
+
+type segment struct {
+	dir  reassembly.TCPFlowDirection
+	data []byte
+}
+
+// conversation is a reassembled TCP connection, both directions
+type conversation struct {
+	network, transport gopacket.Flow
+	start              time.Time
+
+	fps      []lib.Fingerprint // client fingerprints, one per haiku
+	segments []segment
+	size     [2]int
+}
+
+func (c *conversation) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if ctx, ok := ac.(*streamContext); ok && ctx.hasFp && dir == reassembly.TCPDirClientToServer {
+		for _, fp := range c.fps {
+			if fp.Haiku() == ctx.fp.Haiku() {
+				return true
+			}
+		}
+		c.fps = append(c.fps, ctx.fp)
+	}
+
+	// captures often start mid-connection, don't wait for a SYN
+	*start = true
+	return true
+}
+
+func directionIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+func (c *conversation) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	length, _ := sg.Lengths()
+	dir, _, _, _ := sg.Info()
+	if length == 0 {
+		return
+	}
+
+	i := directionIndex(dir)
+	room := maxStreamBytes - c.size[i]
+	if room <= 0 {
+		return
+	}
+
+	data := sg.Fetch(min(length, room))
+	c.size[i] += len(data)
+
+	// consecutive data in the same direction is a single segment
+	if n := len(c.segments); n > 0 && c.segments[n-1].dir == dir {
+		c.segments[n-1].data = append(c.segments[n-1].data, data...)
+		return
+	}
+	c.segments = append(c.segments, segment{dir: dir, data: append([]byte{}, data...)})
+}
+
+func (c *conversation) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	emitConversation(c)
+	return true
+}
+
+// stream returns the data sent in one direction
+func (c *conversation) stream(dir reassembly.TCPFlowDirection) []byte {
+	var buf bytes.Buffer
+	for _, seg := range c.segments {
+		if seg.dir == dir {
+			buf.Write(seg.data)
+		}
+	}
+	return buf.Bytes()
+}
+
+// transcript returns the conversation, client lines prefixed by "> " and
+// server ones by "< ", each segment cut to limit bytes (0 for no limit)
+func (c *conversation) transcript(limit int) string {
+	var sb strings.Builder
+	for _, seg := range c.segments {
+		prefix := "> "
+		if seg.dir == reassembly.TCPDirServerToClient {
+			prefix = "< "
+		}
+
+		data := seg.data
+		if limit > 0 && len(data) > limit {
+			data = data[:limit]
+		}
+
+		sb.WriteString(prefix)
+		sb.WriteString(cmdUtils.PayloadPreview(data, len(data)))
+		if len(data) < len(seg.data) {
+			fmt.Fprintf(&sb, " ... %d more bytes", len(seg.data)-len(data))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+type streamFactory struct{}
+
+func (streamFactory) New(network, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	return &conversation{network: network, transport: transport, start: ac.GetCaptureInfo().Timestamp}
+}
+
+// streamReassembler rebuilds the connections of the capture for -stream
+type streamReassembler struct {
+	assembler *reassembly.Assembler
+	packets   uint64
+}
+
+func newStreamReassembler() *streamReassembler {
+	pool := reassembly.NewStreamPool(streamFactory{})
+	return &streamReassembler{assembler: reassembly.NewAssembler(pool)}
+}
+
+// Feed fingerprints the packet and hands it to the assembler
+func (r *streamReassembler) Feed(packet gopacket.Packet) {
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || packet.NetworkLayer() == nil {
+		return
+	}
+
+	ctx := &streamContext{ci: packet.Metadata().CaptureInfo}
+	if fp, err := annotatedFingerprint(packet); err == nil {
+		ctx.fp, ctx.hasFp = fp, true
+	}
+
+	r.assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, ctx)
+
+	r.packets++
+	if r.packets%streamFlushEvery == 0 {
+		r.assembler.FlushCloseOlderThan(ctx.ci.Timestamp.Add(-streamTimeout))
+	}
+}
+
+// Close completes all the connections still open
+func (r *streamReassembler) Close() {
+	r.assembler.FlushAll()
+}
+
+// emitConversation applies the filters to a completed conversation and shows it
+func emitConversation(c *conversation) {
+	// like single packets, connections without timestamps can't be fingerprinted
+	var matched []lib.Fingerprint
+	for _, fp := range c.fps {
+		if passesFilters(fp) {
+			matched = append(matched, fp)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	if regex != nil && !regex.Match(c.stream(reassembly.TCPDirClientToServer)) && !regex.Match(c.stream(reassembly.TCPDirServerToClient)) {
+		return
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	keys := make([]string, 0, len(matched))
+	for _, fp := range matched {
+		keys = append(keys, fp.Haiku())
+		collectFingerprint(fp.Haiku(), fp.Mode, c.start)
+	}
+
+	src := net.JoinHostPort(c.network.Src().String(), c.transport.Src().String())
+	dst := net.JoinHostPort(c.network.Dst().String(), c.transport.Dst().String())
+
+	if records != nil {
+		writeRecord(cmdUtils.Record{
+			Type:      cmdUtils.RecordStream,
+			Timestamp: c.start.Format(time.RFC3339Nano),
+			SrcIP:     c.network.Src().String(),
+			SrcPort:   binary.BigEndian.Uint16(c.transport.Src().Raw()),
+			DstIP:     c.network.Dst().String(),
+			DstPort:   binary.BigEndian.Uint16(c.transport.Dst().Raw()),
+			Haiku:     strings.Join(keys, ","),
+			Payload:   c.transcript(segmentPreview),
+		})
+		return
+	}
+
+	limit := segmentPreview
+	if *displayData {
+		limit = 0
+	}
+
+	fmt.Fprintf(os.Stderr, "\t\033[32m%21s\033[0m-> %-16s (\033[33m%s\033[0m):\t%s\n\n%s\n",
+		src, dst, strings.Join(keys, ","), c.start, c.transcript(limit))
+}
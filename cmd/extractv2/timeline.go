@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cmdUtils "pcap-go/pkg/cmd-utils"
+)
+
+// Widest sparkline shown, longer timelines merge adjacent slots
+const maxSparkline = 96
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// timeline counts the packets of each fingerprint per time slot, for -timeline
+type timeline struct {
+	slot   time.Duration
+	counts map[string]map[int64]int // fingerprint -> slot start (unix ns) -> packets
+	first  map[string]time.Time
+}
+
+func newTimeline(slot time.Duration) *timeline {
+	return &timeline{slot: slot, counts: make(map[string]map[int64]int), first: make(map[string]time.Time)}
+}
+
+func (tl *timeline) add(key string, ts time.Time) {
+	slots, found := tl.counts[key]
+	if !found {
+		slots = make(map[int64]int)
+		tl.counts[key] = slots
+		tl.first[key] = ts
+	}
+	slots[ts.Truncate(tl.slot).UnixNano()]++
+}
+
+// span returns the first and last slot seen, over all the fingerprints
+func (tl *timeline) span() (first, last int64) {
+	started := false
+	for _, slots := range tl.counts {
+		for slot := range slots {
+			if !started || slot < first {
+				first = slot
+			}
+			if !started || slot > last {
+				last = slot
+			}
+			started = true
+		}
+	}
+	return
+}
+
+// keys returns the fingerprints by first appearance, newcomers last
+func (tl *timeline) keys() []string {
+	keys := make([]string, 0, len(tl.counts))
+	for key := range tl.counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !tl.first[keys[i]].Equal(tl.first[keys[j]]) {
+			return tl.first[keys[i]].Before(tl.first[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// columns returns the packets of a fingerprint from the first to the last
+// slot, each column summing group slots
+func (tl *timeline) columns(key string, first, last int64, group int) []int {
+	step := int64(tl.slot) * int64(group)
+
+	var columns []int
+	for start := first; start <= last; start += step {
+		count := 0
+		for slot := start; slot < start+step; slot += int64(tl.slot) {
+			count += tl.counts[key][slot]
+		}
+		columns = append(columns, count)
+	}
+	return columns
+}
+
+// sparkline draws columns relative to peak, empty ones as blanks
+func sparkline(columns []int, peak int) string {
+	var sb strings.Builder
+	for _, count := range columns {
+		if count == 0 {
+			sb.WriteRune(' ')
+			continue
+		}
+		sb.WriteRune(sparks[min(len(sparks)-1, (count*len(sparks)-1)/peak)])
+	}
+	return sb.String()
+}
+
+// timelineEpilogue shows the timeline, as a sparkline table or as one
+// record per fingerprint and non-empty slot
+func timelineEpilogue() {
+	if len(fgTimeline.counts) == 0 {
+		return
+	}
+
+	keys := fgTimeline.keys()
+
+	if records != nil {
+		for _, key := range keys {
+			slots := make([]int64, 0, len(fgTimeline.counts[key]))
+			for slot := range fgTimeline.counts[key] {
+				slots = append(slots, slot)
+			}
+			sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+			for _, slot := range slots {
+				writeRecord(cmdUtils.Record{
+					Type:      cmdUtils.RecordTimeline,
+					Timestamp: time.Unix(0, slot).UTC().Format(time.RFC3339Nano),
+					Haiku:     key,
+					Count:     fgTimeline.counts[key][slot],
+					Snapshot:  snapshotTime,
+				})
+			}
+		}
+		return
+	}
+
+	first, last := fgTimeline.span()
+	slots := int((last-first)/int64(fgTimeline.slot)) + 1
+	group := (slots + maxSparkline - 1) / maxSparkline
+
+	// the peak is per column, so that merged slots don't saturate
+	peak := 0
+	columns := make(map[string][]int)
+	totals := make(map[string]int)
+	for _, key := range keys {
+		columns[key] = fgTimeline.columns(key, first, last, group)
+		for _, count := range columns[key] {
+			peak = max(peak, count)
+			totals[key] += count
+		}
+	}
+
+	width := 0
+	for _, key := range keys {
+		width = max(width, len(key))
+	}
+
+	fmt.Fprintf(os.Stderr, "\nTimeline from %s to %s, %s per character\n\n",
+		time.Unix(0, first).Format(time.DateTime), time.Unix(0, last).Add(fgTimeline.slot).Format(time.DateTime),
+		fgTimeline.slot*time.Duration(group))
+
+	for _, key := range keys {
+		fmt.Fprintf(os.Stderr, "%-*s %7d |%s|\n", width, key, totals[key], sparkline(columns[key], peak))
+	}
+
+	fmt.Fprintln(os.Stderr, "")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// parseTime parses -since/-until: an RFC3339 time, or a duration before now
+// ("5m" and "-5m" both mean 5 minutes ago). Empty leaves the window open.
+func parseTime(text string, now time.Time) (time.Time, error) {
+	if text == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return time.Time{}, errors.New("want an RFC3339 time or a duration, got " + text)
+	}
+	return now.Add(-d.Abs()), nil
+}
+
+// timeWindow returns the window of packets to consider, the intersection of
+// -since/-until and of -round
+func timeWindow(now time.Time) (since, until time.Time, err error) {
+	if since, err = parseTime(*sinceStr, now); err != nil {
+		return
+	}
+	if until, err = parseTime(*untilStr, now); err != nil {
+		return
+	}
+
+	if *round >= 0 {
+		if *roundStartStr == "" || *roundDuration <= 0 {
+			err = errors.New("-round needs -round-start and -round-duration")
+			return
+		}
+
+		var start time.Time
+		if start, err = time.Parse(time.RFC3339, *roundStartStr); err != nil {
+			return
+		}
+
+		// round N covers [start + N*duration, start + (N+1)*duration)
+		roundSince := start.Add(time.Duration(*round) * *roundDuration)
+		roundUntil := roundSince.Add(*roundDuration)
+
+		if since.IsZero() || roundSince.After(since) {
+			since = roundSince
+		}
+		if until.IsZero() || roundUntil.Before(until) {
+			until = roundUntil
+		}
+	}
+
+	return
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The control API is plain HTTP on a Unix socket only the user running the
+// filter can connect to, never on TCP where the services next to it (or an
+// SSRF in one of them) could whitelist themselves:
+//
+//	GET    /black             list the blacklist
+//	POST   /black?fg=a,b@30m  add fingerprints to the blacklist, optionally expiring
+//	DELETE /black?fg=a,b      remove fingerprints from the blacklist
+//
+// and the same for /white. Every request answers with the updated list,
+// comma separated.
+
+func listHandler(list *fingerprintList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fgs []string
+		if param := r.URL.Query().Get("fg"); param != "" {
+			fgs = strings.Split(param, ",")
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			for _, fg := range fgs {
+				changed, err := list.Add(fg)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if changed {
+					fmt.Println("\033[33mCONTROL:\033[0m added", fg, "to", r.URL.Path)
+				}
+			}
+		case http.MethodDelete:
+			for _, fg := range fgs {
+				if list.Remove(fg) {
+					fmt.Println("\033[33mCONTROL:\033[0m removed", fg, "from", r.URL.Path)
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintln(w, list)
+	}
+}
+
+// listenControl creates the control socket with 0600 permissions, replacing
+// the one a previous run may have left behind
+func listenControl(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", path)
+}
+
+// serveControl starts the control API, it returns once the listener is up
+func serveControl(path string) (*http.Server, error) {
+	listener, err := listenControl(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/black", listHandler(blacklist))
+	mux.Handle("/white", listHandler(whitelist))
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Println("control API error:", err)
+		}
+	}()
+
+	return server, nil
+}
+
+const ctlUsage = `Usage: nfqueue ctl [-control socket] black|white [add|rm fingerprints]
+
+The filter must be running with -control, ` + defaultControlSocket + ` by default.
+
+Examples:
+  nfqueue ctl black                                                 list the blacklist
+  nfqueue ctl black add billowing-violet-stupid,dry-sun-exuberant   block two fingerprints
+  nfqueue ctl white rm misty-dawn-restless                          stop whitelisting one
+  nfqueue ctl black add misty-dawn-restless@30m                     block one for 30 minutes
+`
+
+// runCtl is the client side of the control API, invoked as "nfqueue ctl ..."
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	controlSocket := fs.String("control", defaultControlSocket, "Unix socket of the control API")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, ctlUsage) }
+	fs.Parse(args)
+
+	method := http.MethodGet
+	query := ""
+
+	switch {
+	case fs.NArg() == 1:
+	case fs.NArg() == 3 && fs.Arg(1) == "add":
+		method = http.MethodPost
+		query = "?fg=" + url.QueryEscape(fs.Arg(2))
+	case fs.NArg() == 3 && fs.Arg(1) == "rm":
+		method = http.MethodDelete
+		query = "?fg=" + url.QueryEscape(fs.Arg(2))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if fs.Arg(0) != "black" && fs.Arg(0) != "white" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// the host is ignored, every request goes to the socket
+	req, err := http.NewRequest(method, "http://nfqueue/"+fs.Arg(0)+query, nil)
+	if err != nil {
+		fmt.Println("could not build request:", err)
+		os.Exit(1)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", *controlSocket)
+		},
+	}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("could not reach the control API:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"pcap-go/pkg/lib"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listEntry is a fingerprint with an optional expiry, zero means never
+type listEntry struct {
+	fg      string
+	expires time.Time
+}
+
+func (e listEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// String returns the entry in the same form parseEntry accepts, with an
+// absolute expiry so that it can be pasted back into -black or -white
+func (e listEntry) String() string {
+	if e.expires.IsZero() {
+		return e.fg
+	}
+	return e.fg + "@" + e.expires.Format(time.RFC3339)
+}
+
+// parseEntry parses "haiku", "haiku@30m" (TTL) or "haiku@2024-06-01T12:00:00Z"
+// (absolute expiry). Entries without an expiry get the default TTL, if any.
+func parseEntry(spec string, defaultTTL time.Duration, now time.Time) (listEntry, error) {
+	fg, expiry, found := strings.Cut(strings.TrimSpace(spec), "@")
+	entry := listEntry{fg: strings.TrimSpace(fg)}
+
+	if entry.fg == "" {
+		return entry, fmt.Errorf("empty fingerprint in %q", spec)
+	}
+	if _, err := lib.ParseFingerprint(entry.fg); err != nil {
+		return entry, err
+	}
+
+	if !found {
+		if defaultTTL > 0 {
+			entry.expires = now.Add(defaultTTL)
+		}
+		return entry, nil
+	}
+
+	if ttl, err := time.ParseDuration(expiry); err == nil {
+		entry.expires = now.Add(ttl)
+		return entry, nil
+	}
+
+	expires, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return entry, fmt.Errorf("invalid expiry in %q, want a duration or an RFC3339 time", spec)
+	}
+	entry.expires = expires
+	return entry, nil
+}
+
+// fingerprintList is a black or white list of haikus, safe to update at
+// runtime while the packet hook reads it
+type fingerprintList struct {
+	mu      sync.RWMutex
+	entries []listEntry
+	ttl     time.Duration // default TTL of new entries, 0 for none
+
+	tolerance uint64 // buckets around each entry that still match
+
+	// the unexpired entries parsed, nil when stale: rebuilt after a change
+	// or once the first entry expires
+	set        *lib.FingerprintSet
+	nextExpiry time.Time
+
+	onChange func() // called after every change, if set
+}
+
+func newFingerprintList(specs []string, ttl time.Duration) (*fingerprintList, error) {
+	l := &fingerprintList{ttl: ttl}
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		if _, err := l.Add(spec); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Add inserts a fingerprint, see parseEntry for the accepted forms. Adding a
+// fingerprint already present updates its expiry. It returns false if
+// nothing changed.
+func (l *fingerprintList) Add(spec string) (bool, error) {
+	entry, err := parseEntry(spec, l.ttl, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	found := false
+	for i := range l.entries {
+		if l.entries[i].fg == entry.fg {
+			if l.entries[i].expires.Equal(entry.expires) {
+				l.mu.Unlock()
+				return false, nil
+			}
+			l.entries[i].expires = entry.expires
+			found = true
+			break
+		}
+	}
+	if !found {
+		l.entries = append(l.entries, entry)
+	}
+	l.set = nil
+	l.mu.Unlock()
+
+	l.changed()
+	return true, nil
+}
+
+// Remove deletes a fingerprint, returns false if it was not present
+func (l *fingerprintList) Remove(fg string) bool {
+	fg, _, _ = strings.Cut(strings.TrimSpace(fg), "@")
+
+	l.mu.Lock()
+	for i, entry := range l.entries {
+		if entry.fg == fg {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			l.set = nil
+			l.mu.Unlock()
+
+			l.changed()
+			return true
+		}
+	}
+	l.mu.Unlock()
+
+	return false
+}
+
+// Expire removes the entries expired at now and returns them
+func (l *fingerprintList) Expire(now time.Time) []listEntry {
+	var removed []listEntry
+
+	l.mu.Lock()
+	kept := l.entries[:0]
+	for _, entry := range l.entries {
+		if entry.expired(now) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	l.entries = kept
+	if len(removed) > 0 {
+		l.set = nil
+	}
+	l.mu.Unlock()
+
+	if len(removed) > 0 {
+		l.changed()
+	}
+	return removed
+}
+
+func (l *fingerprintList) changed() {
+	if l.onChange != nil {
+		l.onChange()
+	}
+}
+
+// List returns the entries, with their expiry if they have one
+func (l *fingerprintList) List() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	list := make([]string, 0, len(l.entries))
+	for _, entry := range l.entries {
+		list = append(list, entry.String())
+	}
+	return list
+}
+
+// Contains reports whether the fingerprint is in the list and not expired
+func (l *fingerprintList) Contains(fp lib.Fingerprint) bool {
+	return l.active(time.Now()).Contains(fp)
+}
+
+// active returns the set of the entries not expired at now, parsing them
+// again only when it is stale
+func (l *fingerprintList) active(now time.Time) *lib.FingerprintSet {
+	l.mu.RLock()
+	set := l.set
+	if set != nil && !l.nextExpiry.IsZero() && !now.Before(l.nextExpiry) {
+		set = nil
+	}
+	l.mu.RUnlock()
+
+	if set != nil {
+		return set
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// entries were validated when added
+	l.set, l.nextExpiry = lib.NewFingerprintSet(l.tolerance), time.Time{}
+	for _, entry := range l.entries {
+		if entry.expired(now) {
+			continue
+		}
+		l.set.Add(entry.fg)
+		if !entry.expires.IsZero() && (l.nextExpiry.IsZero() || entry.expires.Before(l.nextExpiry)) {
+			l.nextExpiry = entry.expires
+		}
+	}
+	return l.set
+}
+
+// String returns the entries comma separated, ready for -black or -white
+func (l *fingerprintList) String() string {
+	return strings.Join(l.List(), ",")
+}
+
+// runJanitor removes expired entries from the lists every interval, logging
+// each removal, until ctx is done
+func runJanitor(ctx context.Context, interval time.Duration, lists map[string]*fingerprintList) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for name, list := range lists {
+				for _, entry := range list.Expire(now) {
+					fmt.Println("\033[33mEXPIRED :\033[0m", entry.fg, "from the", name)
+				}
+			}
+		}
+	}
+}
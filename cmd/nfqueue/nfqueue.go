@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"time"
@@ -15,20 +16,26 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/mdlayher/netlink"
 	"pcap-go/pkg/lib"
+	"pcap-go/pkg/haiku"
 )
 
 
-var fgsToMatch []string
-var fgsToUnmatch []string
+var blacklist *fingerprintList
+var whitelist *fingerprintList
 var originalFgsToUnmatch []string
 
-//Host (default 10.60.2.1)
-var host net.IP
+//Hosts, IPv4 and/or IPv6 (default 10.60.1.1)
+var hosts []net.IP
 
 //il regex di Go (RE2) ha una complessità temporale assicurata di O(N)
 var flagRegex = regexp.MustCompile(`[A-Z0-9]{31}=`)
 var secretRegex *regexp.Regexp 
 
+//exploit signatures for automatic blacklisting, nil if -rules is not set
+var rules *attackRules
+
+var annotator = lib.NewAnnotator()
+
 func printBody(body []byte, packet gopacket.Packet, fp lib.Fingerprint, id uint32) {
     body = body[min(len(body), 100):]
     // replace non-printable characters with .
@@ -40,9 +47,9 @@ func printBody(body []byte, packet gopacket.Packet, fp lib.Fingerprint, id uint3
 
     if len(body) != 0 {
         networkFlow := packet.NetworkLayer().NetworkFlow()
-        fmt.Printf("[%d]\t\033[32m%s\033[0m -> %s (\033[33m%s\033[0m:%d): %s\n", id,
+        fmt.Printf("[%d]\t\033[32m%s\033[0m -> %s (\033[33m%s\033[0m:%d%s): %s\n", id,
             networkFlow.Src().String(), networkFlow.Dst().String(),
-            fp, fp.Delta, body)
+            fp, fp.Delta, fp.Details(), body)
     }
 
 }
@@ -50,27 +57,26 @@ func printBody(body []byte, packet gopacket.Packet, fp lib.Fingerprint, id uint3
 func processPacket(nf *nfqueue.Nfqueue) nfqueue.HookFunc {
 	return func(a nfqueue.Attribute) int {
         var fp lib.Fingerprint
+        var millis, tsVal uint64
         var errFg error
 		id := *a.PacketID
 
-		packet := gopacket.NewPacket(*a.Payload, layers.LayerTypeIPv4, gopacket.Default)
-
-        
+		packet := lib.DecodeIPPacket(*a.Payload)
 
 		tcpLayer := packet.Layer(layers.LayerTypeTCP)
 
-		body := tcpLayer.LayerPayload()
-
 		if tcpLayer == nil { // skip non-TCP packets
 			_ = nf.SetVerdict(id, nfqueue.NfAccept)
 			return 0
 		}
 
+		body := tcpLayer.LayerPayload()
+
         //è successo sul mio server con Debian, meglio avere un fallback e non crashare
         if(a.Timestamp == nil) {
-		    fp, _, _, errFg = lib.ExtractFingerprintRealTimeFallback(packet)
+		    fp, millis, tsVal, errFg = lib.ExtractFingerprintRealTimeFallback(packet)
         } else {
-		    fp, _, _, errFg = lib.ExtractFingerprintRealTime(packet, *a.Timestamp)
+		    fp, millis, tsVal, errFg = lib.ExtractFingerprintRealTime(packet, *a.Timestamp)
         }
 
 		if errFg != nil {
@@ -78,6 +84,8 @@ func processPacket(nf *nfqueue.Nfqueue) nfqueue.HookFunc {
 			return 0
 		}
 
+        annotator.Annotate(packet, &fp, millis, tsVal)
+
         dst := packet.NetworkLayer().NetworkFlow().Dst()
         dstIp := net.IP(dst.Raw())
 
@@ -85,10 +93,10 @@ func processPacket(nf *nfqueue.Nfqueue) nfqueue.HookFunc {
 
         //no flag ins shall be reject
         //statisticamente la flag falsa più comune è AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=, ignoriamola
-        if  dstIp.Equal(host) && matchedFlag != "" && matchedFlag != "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" || (*secretRegexString != "" && secretRegex.Match(body))  {
+        if  isHost(dstIp) && matchedFlag != "" && matchedFlag != "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" || (*secretRegexString != "" && secretRegex.Match(body))  {
             fmt.Println("\033[33mFLAG-IN OR SECRET DETECTED :\033[0m ", fp)
-            if(!fp.ContainedIn(fgsToUnmatch)) {
-		        fgsToUnmatch = append(fgsToUnmatch, fp.Haiku())
+            if(!whitelist.Contains(fp)) {
+		        whitelist.Add(fp.Haiku())
             }
 
             printBody(body, packet, fp, id)
@@ -96,9 +104,17 @@ func processPacket(nf *nfqueue.Nfqueue) nfqueue.HookFunc {
 			_ = nf.SetVerdict(id, nfqueue.NfAccept)
             return 0
 	    }
+
+        //exploit signatures: blacklist the fg after enough hits, unless whitelisted
+        if rules != nil && !whitelist.Contains(fp) && !blacklist.Contains(fp) {
+            if rule := rules.Match(body); rule != nil && rules.Hit(fp.Haiku()) {
+                fmt.Printf("\033[31mAUTO-BLACKLISTED :\033[0m %s (rule %q)\n", fp, rule)
+                blacklist.Add(fp.Haiku())
+            }
+        }
         
         //only match if the fg is in the blacklist and not in the whitelist
-	    if *fingerprintToMatch != "" && fp.ContainedIn(fgsToMatch) && !fp.ContainedIn(fgsToUnmatch) {
+	    if blacklist.Contains(fp) && !whitelist.Contains(fp) {
 			_ = nf.SetVerdict(id, nfqueue.NfDrop)
 			return 0
         }
@@ -111,6 +127,15 @@ func processPacket(nf *nfqueue.Nfqueue) nfqueue.HookFunc {
 }
 
 
+func isHost(ip net.IP) bool {
+    for _, h := range hosts {
+        if h.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
+
 func difference(slice1, slice2 []string) []string {
     diff := []string{}
     seen := make(map[string]bool)
@@ -128,48 +153,107 @@ func difference(slice1, slice2 []string) []string {
     return diff
 }
 
-func removeDuplicates(elements []string) []string {
-    seen := make(map[string]bool)
-    unique := []string{}
-
-    for _, element := range elements {
-        if _, found := seen[element]; !found {
-            seen[element] = true
-            unique = append(unique, element)
-        }
-    }
-
-    return unique
-}
-
 var (
 	queueNum             = flag.Uint("queue", 420, "nfqueue queue number")
 	fingerprintToMatch   = flag.String("black", "", "fingerprints to block")
 	fingerprintToUnmatch = flag.String("white", "", "fingerprints to NOT block initially (ovverrides the blacklist if necessary)")
-    hostString           = flag.String("host", "10.60.1.1", "host ip, in order to find flag ins")
+    hostString           = flag.String("host", "10.60.1.1", "comma separated host ips (v4 or v6), in order to find flag ins")
     secretRegexString    = flag.String("secret", "", "secret regex to whitelist arbirary hosts")
+    controlSocket        = flag.String("control", "", "Unix socket to serve the control API on (e.g. "+defaultControlSocket+"), disabled by default")
+    stateFile            = flag.String("state", "", "file to persist the black/white lists to, reloaded on startup")
+    blackTTL             = flag.Duration("black-ttl", 0, "default expiry of blacklist entries, 0 for never (per entry: fingerprint@30m)")
+    whiteTTL             = flag.Duration("white-ttl", 0, "default expiry of whitelist entries, 0 for never (per entry: fingerprint@30m)")
+    precision            = flag.Duration("precision", 10*time.Second, "width of the fingerprint buckets")
+    wrapBits             = flag.Uint("wrap", 18, "fingerprints wrap around at 2^wrap buckets")
+    dictionary           = flag.String("dict", "haiku", "word list of the haikus, built-in ("+strings.Join(haiku.Dictionaries(), ", ")+") or a file with a word per line")
+    tolerance            = flag.Uint64("tolerance", 0, "also match fingerprints up to N buckets away from a listed one")
+    rulesFile            = flag.String("rules", "", "file of exploit regexes (one per line), matching fingerprints get blacklisted")
+    ruleHits             = flag.Int("rule-hits", 3, "rule matches needed before a fingerprint is blacklisted")
 )
 
+// where nfqueue ctl looks for the control API by default
+const defaultControlSocket = "/run/nfqueue.sock"
+
+//how often expired black/white entries are removed
+const janitorInterval = 10 * time.Second
+
 func main() {
     var err error
+
+    if len(os.Args) > 1 && os.Args[1] == "ctl" {
+        runCtl(os.Args[2:])
+        return
+    }
+
 	flag.Parse()
 
-    host = net.ParseIP(*hostString)
+    for _, h := range strings.Split(*hostString, ",") {
+        ip := net.ParseIP(strings.TrimSpace(h))
+        if ip == nil {
+            fmt.Println("could not parse IP", h)
+            continue
+        }
+        hosts = append(hosts, ip)
+    }
+
     if(*secretRegexString != "") {
 		secretRegex = regexp.MustCompile(*secretRegexString)
     }
 
-    if host == nil {
-		fmt.Println("could not parse IP")
+    if *rulesFile != "" {
+        rules, err = loadRules(*rulesFile, *ruleHits)
+        if err != nil {
+            fmt.Println("could not load rules:", err)
+            os.Exit(1)
+        }
+        fmt.Println("loaded", len(rules.regexes), "exploit rules")
     }
 
-    if(*fingerprintToMatch != "") {
-        fgsToMatch = strings.Split(*fingerprintToMatch, ",")
+    err = lib.SetConfig(lib.Config{Precision: uint64(precision.Milliseconds()), Bits: *wrapBits, Dictionary: *dictionary})
+    if err != nil {
+        fmt.Println("invalid fingerprint settings:", err)
+        os.Exit(1)
     }
 
-    if(*fingerprintToUnmatch != "") { 
-        fgsToUnmatch = strings.Split(*fingerprintToUnmatch, ",")
-        originalFgsToUnmatch = strings.Split(*fingerprintToUnmatch, ",")
+    blacklist, err = newFingerprintList(strings.Split(*fingerprintToMatch, ","), *blackTTL)
+    if err != nil {
+        fmt.Println("could not parse blacklist:", err)
+        os.Exit(1)
+    }
+
+    whitelist, err = newFingerprintList(strings.Split(*fingerprintToUnmatch, ","), *whiteTTL)
+    if err != nil {
+        fmt.Println("could not parse whitelist:", err)
+        os.Exit(1)
+    }
+    originalFgsToUnmatch = whitelist.List()
+
+    blacklist.tolerance = *tolerance
+    whitelist.tolerance = *tolerance
+
+    var saver *stateSaver
+    if *stateFile != "" {
+        st, err := loadState(*stateFile)
+        if err != nil {
+            fmt.Println("could not load state:", err)
+            os.Exit(1)
+        }
+
+        for _, fg := range st.Black {
+            if _, err := blacklist.Add(fg); err != nil {
+                fmt.Println("skipping state entry:", err)
+            }
+        }
+        for _, fg := range st.White {
+            if _, err := whitelist.Add(fg); err != nil {
+                fmt.Println("skipping state entry:", err)
+            }
+        }
+
+        saver = newStateSaver(*stateFile)
+        blacklist.onChange = saver.Notify
+        whitelist.onChange = saver.Notify
+        saver.Notify()
     }
 
 	config := nfqueue.Config{
@@ -198,6 +282,11 @@ func main() {
 		cancel()
 	}()
 
+	go runJanitor(ctx, janitorInterval, map[string]*fingerprintList{
+		"blacklist": blacklist,
+		"whitelist": whitelist,
+	})
+
 	errorFunc := func(e error) int {
 		fmt.Println("error:", e)
 		return 0
@@ -210,6 +299,15 @@ func main() {
 		os.Exit(1)
 	}
 
+    var control *http.Server
+    if *controlSocket != "" {
+        control, err = serveControl(*controlSocket)
+        if err != nil {
+            fmt.Println("could not start control API:", err)
+            os.Exit(1)
+        }
+    }
+
 	// Block till the context expires
 	<-ctx.Done()
 
@@ -220,12 +318,20 @@ func main() {
 		os.Exit(1)
 	}
 
-    deduplicated := removeDuplicates(fgsToUnmatch)
+    if control != nil {
+        control.Close()
+    }
+
+    if saver != nil {
+        saver.Close()
+    }
+
+    updated := whitelist.List()
 
     fmt.Println("Updated whitelist: ")
 
-    for i, fg := range deduplicated {
-        if i < len(deduplicated)-1 {
+    for i, fg := range updated {
+        if i < len(updated)-1 {
             fmt.Print(fg, ",")
         } else {
             fmt.Print(fg)
@@ -234,7 +340,7 @@ func main() {
 
     fmt.Println("")
 
-    new_fgs := difference(fgsToUnmatch, originalFgsToUnmatch)
+    new_fgs := difference(updated, originalFgsToUnmatch)
 
     fmt.Println("New whitelisted fingerprints: ")
 
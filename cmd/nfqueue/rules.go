@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// fingerprints whose rule matches are counted, the ones matching least
+// recently are forgotten beyond
+const maxRuleFingerprints = 1 << 14
+
+// attackRules are exploit signatures matched against the payloads: once a
+// fingerprint has matched them enough times it is blacklisted
+type attackRules struct {
+	regexes   []*regexp.Regexp
+	threshold int
+
+	mu            sync.Mutex
+	hits, oldHits map[string]int // two generations, see Hit
+}
+
+// loadRules reads one regex per line, blank lines and lines starting with #
+// are skipped
+func loadRules(path string, threshold int) (*attackRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := &attackRules{threshold: max(threshold, 1), hits: make(map[string]int), oldHits: make(map[string]int)}
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		regex, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		rules.regexes = append(rules.regexes, regex)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Match returns the first rule matching the body, nil if none does
+func (r *attackRules) Match(body []byte) *regexp.Regexp {
+	for _, regex := range r.regexes {
+		if regex.Match(body) {
+			return regex
+		}
+	}
+	return nil
+}
+
+// Hit counts a match for the fingerprint and reports whether it reached the
+// threshold. The count then starts over, so that the fingerprint gets
+// blacklisted again if its entry expires or is removed. Counts live in two
+// generations, the older one being dropped when the current one is full, so
+// memory stays bounded without forgetting the fingerprints matching lately.
+func (r *attackRules) Hit(fg string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hits := r.hits[fg] + r.oldHits[fg] + 1
+	delete(r.oldHits, fg)
+	if hits >= r.threshold {
+		delete(r.hits, fg)
+		return true
+	}
+
+	if _, found := r.hits[fg]; !found && len(r.hits) >= maxRuleFingerprints/2 {
+		r.oldHits, r.hits = r.hits, make(map[string]int)
+	}
+	r.hits[fg] = hits
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// state is what is persisted to the -state file
+type state struct {
+	Black   []string `json:"black"`
+	White   []string `json:"white"`
+	Learned []string `json:"learned"` // whitelisted at runtime from flag ins
+}
+
+// loadState reads the state file, a missing file is an empty state
+func loadState(path string) (state, error) {
+	var st state
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// saveState writes the state to a temporary file next to path and renames it
+// over path, so a crash never leaves a truncated state behind
+func saveState(path string, st state) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// currentState snapshots the lists
+func currentState() state {
+	white := whitelist.List()
+	return state{
+		Black:   blacklist.List(),
+		White:   white,
+		Learned: difference(white, originalFgsToUnmatch),
+	}
+}
+
+// stateSaver persists the lists every time they change. Saves happen in the
+// background so the packet hook never waits on the disk, changes made while a
+// save is running are coalesced into the next one.
+type stateSaver struct {
+	path    string
+	changed chan struct{}
+	done    chan struct{}
+
+	// the janitor, control handlers and packet hook may still notify while
+	// the saver is being closed
+	mu     sync.Mutex
+	closed bool
+}
+
+func newStateSaver(path string) *stateSaver {
+	s := &stateSaver{
+		path:    path,
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		for range s.changed {
+			if err := saveState(s.path, currentState()); err != nil {
+				fmt.Println("could not save state:", err)
+			}
+		}
+	}()
+
+	return s
+}
+
+// Notify schedules a save, it never blocks. Changes notified after Close are
+// not saved.
+func (s *stateSaver) Notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Close flushes the last save
+func (s *stateSaver) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.changed)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
@@ -2,6 +2,7 @@ package cmdUtils
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"pcap-go/pkg/lib"
 	"regexp"
@@ -82,13 +83,11 @@ func ShowBodyInfo(packet gopacket.Packet, fp lib.Fingerprint, displayContent boo
 	    //tsVal, tsEcho, _ := lib.ExtractTimestamps(tcpPacket.Options)
         
 
-        fmt.Fprintf(os.Stderr, "\t\033[32m%15s:%-5s\033[0m-> %-10s:%-5s %20s:\t%s\n\n %s\n",
-            
-			networkFlow.Src().String(),
-            tcpFlow.Src().String(),
-			networkFlow.Dst().String(),
-            tcpFlow.Dst().String(),
-            fmt.Sprintf("(\033[33m%s\033[0m:%d)", fp, fp.Delta),
+        // JoinHostPort brackets IPv6 addresses, e.g. [fd00::1]:8080
+        fmt.Fprintf(os.Stderr, "\t\033[32m%21s\033[0m-> %-16s %20s:\t%s\n\n %s\n",
+            net.JoinHostPort(networkFlow.Src().String(), tcpFlow.Src().String()),
+            net.JoinHostPort(networkFlow.Dst().String(), tcpFlow.Dst().String()),
+            fmt.Sprintf("(\033[33m%s\033[0m:%d%s)", fp, fp.Delta, fp.Details()),
             packet.Metadata().Timestamp,
 			body)
 	}
@@ -0,0 +1,197 @@
+package cmdUtils
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"pcap-go/pkg/lib"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Record types
+const (
+	RecordPacket      = "packet"
+	RecordFingerprint = "fingerprint" // -L
+	RecordFrequency   = "frequency"   // -F
+	RecordStream      = "stream"      // -stream, the payload is the transcript
+	RecordTimeline    = "timeline"    // -timeline, the packets of a fingerprint in the slot starting at timestamp
+)
+
+// Record is a machine-readable output line, the fields that do not apply to
+// its type are left empty
+type Record struct {
+	Type      string  `json:"type"`
+	Timestamp string  `json:"timestamp,omitempty"`
+	SrcIP     string  `json:"src_ip,omitempty"`
+	SrcPort   uint16  `json:"src_port,omitempty"`
+	DstIP     string  `json:"dst_ip,omitempty"`
+	DstPort   uint16  `json:"dst_port,omitempty"`
+	TSval     uint64  `json:"tsval,omitempty"`
+	TSecr     uint64  `json:"tsecr,omitempty"`
+	Delta     *uint64 `json:"delta,omitempty"`
+	Haiku     string  `json:"haiku"`
+	Mode      string  `json:"mode,omitempty"`
+	Count     int     `json:"count,omitempty"`
+	Payload   string  `json:"payload,omitempty"`
+	Snapshot  string  `json:"snapshot,omitempty"` // time of the summary the fingerprint, frequency or timeline record belongs to
+	Encoding  string  `json:"encoding,omitempty"` // dictionary the haiku of a packet record is written with
+}
+
+var csvHeader = []string{"type", "timestamp", "src_ip", "src_port", "dst_ip", "dst_port",
+	"tsval", "tsecr", "delta", "haiku", "mode", "count", "payload", "snapshot", "encoding"}
+
+func (r Record) csvRow() []string {
+	itoa := func(n uint64) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.FormatUint(n, 10)
+	}
+
+	delta := ""
+	if r.Delta != nil {
+		delta = strconv.FormatUint(*r.Delta, 10)
+	}
+
+	return []string{r.Type, r.Timestamp, r.SrcIP, itoa(uint64(r.SrcPort)), r.DstIP, itoa(uint64(r.DstPort)),
+		itoa(r.TSval), itoa(r.TSecr), delta, r.Haiku, r.Mode, itoa(uint64(r.Count)), r.Payload, r.Snapshot, r.Encoding}
+}
+
+// PayloadPreview returns up to n bytes of the payload, with non-printable
+// characters replaced by dots
+func PayloadPreview(body []byte, n int) string {
+	preview := make([]byte, 0, min(len(body), n))
+	for _, c := range body[:min(len(body), n)] {
+		if c < 32 || c > 126 {
+			c = '.'
+		}
+		preview = append(preview, c)
+	}
+	return string(preview)
+}
+
+// NewPacketRecord builds the record of a fingerprinted packet
+func NewPacketRecord(packet gopacket.Packet, fp lib.Fingerprint, key string) Record {
+	rec := Record{
+		Type:      RecordPacket,
+		Timestamp: packet.Metadata().Timestamp.Format(time.RFC3339Nano),
+		Haiku:     key,
+		Mode:      fp.Mode,
+		Encoding:  fp.Encoding,
+	}
+
+	// the Delta of skewed fingerprints is meaningless
+	if !fp.Skewed {
+		delta := fp.Delta
+		rec.Delta = &delta
+	}
+
+	if network := packet.NetworkLayer(); network != nil {
+		rec.SrcIP = network.NetworkFlow().Src().String()
+		rec.DstIP = network.NetworkFlow().Dst().String()
+	}
+
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		rec.SrcPort = uint16(tcp.SrcPort)
+		rec.DstPort = uint16(tcp.DstPort)
+		rec.TSval, rec.TSecr, _ = lib.ExtractTimestamps(tcp.Options)
+		rec.Payload = PayloadPreview(tcp.LayerPayload(), 64)
+	}
+
+	return rec
+}
+
+// RecordWriter writes records in a machine-readable format
+type RecordWriter interface {
+	Write(Record) error
+	Close() error
+}
+
+// NewRecordWriter returns a buffered writer for "json" (a single array),
+// "ndjson" (one object per line) or "csv", Close flushes it
+func NewRecordWriter(format string, w io.Writer) (RecordWriter, error) {
+	switch format {
+	case "json":
+		return &jsonWriter{w: bufio.NewWriter(w)}, nil
+	case "ndjson":
+		buf := bufio.NewWriter(w)
+		return &ndjsonWriter{buf: buf, enc: json.NewEncoder(buf)}, nil
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, want json, ndjson or csv", format)
+	}
+}
+
+type ndjsonWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) Write(r Record) error { return nw.enc.Encode(r) }
+func (nw *ndjsonWriter) Close() error         { return nw.buf.Flush() }
+
+// jsonWriter streams the array, so that memory does not grow with the capture
+type jsonWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+func (jw *jsonWriter) Write(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	sep := ",\n"
+	if !jw.started {
+		sep = "[\n"
+		jw.started = true
+	}
+
+	_, err = fmt.Fprintf(jw.w, "%s%s", sep, data)
+	return err
+}
+
+func (jw *jsonWriter) Close() error {
+	end := "\n]"
+	if !jw.started {
+		end = "[]"
+	}
+
+	if _, err := fmt.Fprintln(jw.w, end); err != nil {
+		return err
+	}
+	return jw.w.Flush()
+}
+
+type csvWriter struct {
+	w       *csv.Writer
+	started bool
+}
+
+func (cw *csvWriter) Write(r Record) error {
+	if !cw.started {
+		cw.started = true
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	return cw.w.Write(r.csvRow())
+}
+
+func (cw *csvWriter) Close() error {
+	if !cw.started {
+		cw.w.Write(csvHeader)
+	}
+
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,118 @@
+package haiku
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Edits allowed over a whole haiku when correcting it
+const maxEdits = 2
+
+// ErrAmbiguous is returned by Correct when several haikus are equally near
+var ErrAmbiguous = errors.New("ambiguous haiku")
+
+// editDistance returns the number of insertions, deletions, substitutions and
+// transpositions of adjacent letters turning a into b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// three rows of the dynamic programming table, for transpositions
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(rb)]
+}
+
+type candidate struct {
+	word  string
+	edits int
+}
+
+// candidates returns the dictionary words at most maxEdits away from word
+func candidates(word string) []candidate {
+	var found []candidate
+	for _, w := range current.words {
+		if d := editDistance(word, w); d <= maxEdits {
+			found = append(found, candidate{w, d})
+		}
+	}
+	return found
+}
+
+// Correct returns the valid haiku nearest to a mistyped one: the one needing
+// the fewest edits of its words, at most 2 in total. Ambiguous haikus, with
+// several valid ones equally near, are rejected. Haikus of the wrong length,
+// like the shorter ones of older versions, are not completed: they encoded
+// fingerprints differently, any completion would name another one.
+func Correct(haiku string) (string, error) {
+	words := strings.Split(strings.ToLower(strings.TrimSpace(haiku)), "-")
+	if len(words) != length {
+		return "", fmt.Errorf("haiku %q has %d words, expected %d", haiku, len(words), length)
+	}
+
+	options := make([][]candidate, length)
+	for i, word := range words {
+		if options[i] = candidates(word); len(options[i]) == 0 {
+			return "", fmt.Errorf("no word close to %q", word)
+		}
+	}
+
+	best := maxEdits
+	var nearest []string
+
+	chosen := make([]string, length)
+	var search func(i, edits int)
+	search = func(i, edits int) {
+		if edits > best {
+			return
+		}
+
+		if i == length {
+			h := strings.Join(chosen, "-")
+			if _, err := ParseHaiku(h); err != nil {
+				return
+			}
+			if edits < best {
+				best, nearest = edits, nil
+			}
+			nearest = append(nearest, h)
+			return
+		}
+
+		for _, c := range options[i] {
+			chosen[i] = c.word
+			search(i+1, edits+c.edits)
+		}
+	}
+	search(0, 0)
+
+	switch {
+	case len(nearest) == 0:
+		return "", errors.New("no valid haiku close enough")
+	case len(nearest) > 1:
+		return "", fmt.Errorf("%w, could be %s", ErrAmbiguous, strings.Join(nearest, " or "))
+	}
+
+	return nearest[0], nil
+}
@@ -340,7 +340,7 @@ var dictionary = []string{
 	"obedient",
 	"obnoxious",
 	"odd",
-	"old-fashioned",
+	"vintage",
 	"outrageous",
 	"outstanding",
 	"panicky",
@@ -394,7 +394,7 @@ var dictionary = []string{
 	"wacky",
 	"weary",
 	"wicked",
-	"wide-eyed",
+	"startled",
 	"witty",
 	"wonderful",
 	"worried",
@@ -0,0 +1,167 @@
+package haiku
+
+import (
+	"bufio"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/vishalkuo/bimap"
+)
+
+// DefaultDictionary is the name of the built-in word list
+const DefaultDictionary = "haiku"
+
+//go:embed dictionaries/*.txt
+var embedded embed.FS
+
+// Dictionary is a named list of words haikus are made of, the position of a
+// word is its digit
+type Dictionary struct {
+	Name  string
+	words []string
+	index *bimap.BiMap[string, int]
+}
+
+// ValidateWords checks a word list for the words that would make haikus
+// ambiguous: empty, duplicated, not lowercase, or containing the characters
+// separating words ("-"), settings ("~"), expiries ("@"), list entries (",")
+// and stack signatures ("/"). All the problems are reported.
+func ValidateWords(words []string) error {
+	var errs []error
+
+	if len(words) < 2 {
+		errs = append(errs, fmt.Errorf("a dictionary needs at least 2 words, got %d", len(words)))
+	}
+
+	seen := make(map[string]int, len(words))
+	for i, word := range words {
+		switch {
+		case word == "":
+			errs = append(errs, fmt.Errorf("word %d is empty", i+1))
+		case strings.ContainsAny(word, "-~@,/") || strings.IndexFunc(word, isSpace) >= 0:
+			errs = append(errs, fmt.Errorf("word %d %q contains a separator", i+1, word))
+		case strings.ToLower(word) != word:
+			errs = append(errs, fmt.Errorf("word %d %q is not lowercase", i+1, word))
+		}
+
+		if first, found := seen[word]; found {
+			errs = append(errs, fmt.Errorf("word %d %q duplicates word %d", i+1, word, first+1))
+		} else {
+			seen[word] = i
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func isSpace(r rune) bool { return r == ' ' || r == '\t' || r == '\r' || r == '\n' }
+
+// NewDictionary validates a word list and indexes it
+func NewDictionary(name string, words []string) (*Dictionary, error) {
+	if err := ValidateWords(words); err != nil {
+		return nil, fmt.Errorf("invalid dictionary %q: %w", name, err)
+	}
+
+	index := bimap.NewBiMap[string, int]()
+	for i, word := range words {
+		index.Insert(word, i)
+	}
+	index.MakeImmutable()
+
+	return &Dictionary{Name: name, words: words, index: index}, nil
+}
+
+// readWords reads a word list, one word per line, skipping blank lines and
+// "#" comments
+func readWords(r io.Reader) ([]string, error) {
+	var words []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+
+	return words, scanner.Err()
+}
+
+// Dictionaries returns the names of the built-in dictionaries
+func Dictionaries() []string {
+	names := []string{DefaultDictionary}
+
+	entries, _ := embedded.ReadDir("dictionaries")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".txt"))
+	}
+
+	sort.Strings(names[1:])
+	return names
+}
+
+// checkFileName rejects the names of file dictionaries that would make their
+// haikus look like the ones of another dictionary: the names of the built-in
+// ones, "skew" which ends the tag of skew fingerprints, and the ones with
+// separators
+func checkFileName(name string) error {
+	if slices.Contains(Dictionaries(), name) || name == "skew" {
+		return fmt.Errorf("the name %q is taken, rename the file", name)
+	}
+	if name == "" || strings.ContainsAny(name, "~@,/ \t") {
+		return fmt.Errorf("the name %q can't be used in a tag, rename the file", name)
+	}
+	return nil
+}
+
+// LoadDictionary returns a built-in dictionary by name, or reads one from a
+// file, named after the file
+func LoadDictionary(spec string) (*Dictionary, error) {
+	if spec == DefaultDictionary {
+		return NewDictionary(DefaultDictionary, dictionary)
+	}
+
+	var file fs.File
+	err := fs.ErrNotExist
+	name := spec
+	if !strings.ContainsAny(spec, `/\`) {
+		file, err = embedded.Open("dictionaries/" + spec + ".txt")
+	}
+	if err != nil {
+		if file, err = os.Open(spec); err != nil {
+			return nil, fmt.Errorf("no dictionary named %s (built-in ones: %s) and %w",
+				spec, strings.Join(Dictionaries(), ", "), err)
+		}
+		name = strings.TrimSuffix(filepath.Base(spec), filepath.Ext(spec))
+		if err := checkFileName(name); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("dictionary %s: %w", spec, err)
+		}
+	}
+	defer file.Close()
+
+	words, err := readWords(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDictionary(name, words)
+}
+
+// Len returns the number of words
+func (d *Dictionary) Len() int { return len(d.words) }
+
+// Word returns the word of a digit
+func (d *Dictionary) Word(i int) string { return d.words[i] }
+
+// Digit returns the digit of a word
+func (d *Dictionary) Digit(word string) (int, bool) { return d.index.Get(word) }
@@ -1,85 +1,131 @@
 package haiku
 
 import (
-    "math"
-    "slices"
+    "errors"
+    "fmt"
+    "hash/fnv"
     "strings"
-    "github.com/vishalkuo/bimap"
 )
 
-var biMap = bimap.NewBiMap[string, int]()
+// current is the dictionary haikus are written with, see SetDictionary
+var current *Dictionary
 
 func init() {
-    for i, word := range dictionary {
-        biMap.Insert(word, i)
+    d, err := NewDictionary(DefaultDictionary, dictionary)
+    if err != nil {
+        panic(err)
     }
 
-    biMap.MakeImmutable()
+    current = d
+    SetSpace(DefaultSpace)
 }
 
-//Base conv functions
-func toDigits(n, b int) []int {
-    capacity := int(math.Log(float64(n))/math.Log(float64(b))) + 1
-    digits := make([]int, 0, capacity) // Pre-allocation
-    for n > 0 {
-        digits = append(digits, n%b)
-        n /= b
+// Haikus have a fixed number of words, enough to encode every fingerprint of
+// the space along with a checksum of at least minChecks values, so that most
+// typos are caught instead of naming another fingerprint
+const (
+    DefaultSpace = 1 << 18
+    minChecks    = 256
+)
+
+var (
+    space  int // fingerprints encoded, 0 to space-1
+    length int // words per haiku
+    checks int // checksum values
+)
+
+// SetSpace sets the number of fingerprints encoded, which decides the length
+// of the haikus along with the dictionary: 3 words for the default 2^18
+func SetSpace(size int) error {
+    if size <= 0 {
+        return errors.New("the haiku space must not be empty")
     }
 
-    slices.Reverse(digits)
+    n, l := 1, 0
+    for n < size*minChecks {
+        n *= current.Len()
+        l++
+    }
+
+    space, length, checks = size, l, n/size
+    return nil
+}
 
-    return digits
+// SetDictionary changes the words haikus are written with, their length is
+// adjusted to the dictionary size
+func SetDictionary(d *Dictionary) {
+    current = d
+    SetSpace(space)
 }
 
+// CurrentDictionary returns the dictionary in use
+func CurrentDictionary() *Dictionary { return current }
 
-func fromDigits(digits []int, b int) int {
-	n := 0
-	for _, d := range digits {
-		n = b*n + d
-	}
-	return n
+// checksum of a fingerprint, it spreads neighbouring ones apart
+func checksum(n int) int {
+    h := fnv.New32a()
+    h.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+    return int(h.Sum32() % uint32(checks))
 }
 
-func formatToDictionary(digits []int) (string) {
-    resStr := ""
+// ToHaiku encodes a fingerprint, taken modulo the space, as a haiku of
+// fixed length. Every fingerprint has exactly one haiku.
+func ToHaiku(n int) (string) {
+    n = (n%space + space) % space
+    total := n*checks + checksum(n)
 
-    for i, d := range digits {
-        word, _ := biMap.GetInverse(d)
-        if i == len(digits)-1 {
-            resStr += word
-        } else {
-            resStr +=  word + "-"
-        }
+    words := make([]string, length)
+    for i := length - 1; i >= 0; i-- {
+        words[i] = current.Word(total % current.Len())
+        total /= current.Len()
     }
 
-    return resStr
+    return strings.Join(words, "-")
 }
 
-func haikuToDigits(haiku string) ([]int) {
-    words := strings.Split(haiku, "-")
-    digits := make([]int, 0, len(words))
+// ParseHaiku decodes a haiku, rejecting the ones of the wrong length, with
+// unknown words or failing the checksum
+func ParseHaiku(haiku string) (int, error) {
+    words := strings.Split(strings.ToLower(strings.TrimSpace(haiku)), "-")
+    if len(words) != length {
+        return 0, fmt.Errorf("haiku %q has %d words, expected %d", haiku, len(words), length)
+    }
 
+    total := 0
     for _, word := range words {
-        d, _ := biMap.Get(word)
-        digits = append(digits, d)
+        d, ok := current.Digit(word)
+        if !ok {
+            return 0, fmt.Errorf("unknown word %q in haiku %q", word, haiku)
+        }
+        total = total*current.Len() + d
     }
 
-    return digits
-}
+    n, check := total/checks, total%checks
+    if n >= space || check != checksum(n) {
+        return 0, fmt.Errorf("haiku %q fails its checksum, some word is mistyped", haiku)
+    }
 
-func ToHaiku(n int) (string) {
-    return formatToDictionary(toDigits(n, len(dictionary)))
+    return n, nil
 }
 
+// FromHaiku is like ParseHaiku, returning -1 for invalid haikus so that they
+// don't match any fingerprint
 func FromHaiku(haiku string) (int) {
-    return fromDigits(haikuToDigits(haiku), len(dictionary))
+    n, err := ParseHaiku(haiku)
+    if err != nil {
+        return -1
+    }
+    return n
 }
 
+// FromHaikus decodes a list of haikus, dropping the invalid ones
 func FromHaikus(haiku []string) ([]int) {
     fgs := make([]int, 0, len(haiku))
 
     for _, h := range haiku {
-        fgs = append(fgs, FromHaiku(h))
+        if n, err := ParseHaiku(h); err == nil {
+            fgs = append(fgs, n)
+        }
     }
 
     return fgs
@@ -0,0 +1,87 @@
+package haiku
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHaikuRoundTrip(t *testing.T) {
+	seen := make(map[string]int, DefaultSpace)
+	for n := 0; n < DefaultSpace; n++ {
+		h := ToHaiku(n)
+		if words := strings.Split(h, "-"); len(words) != length {
+			t.Fatalf("%d: haiku %q has %d words, want %d", n, h, len(words), length)
+		}
+		if prev, found := seen[h]; found {
+			t.Fatalf("%d and %d share the haiku %q", prev, n, h)
+		}
+		seen[h] = n
+
+		got, err := ParseHaiku(h)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+		if got != n {
+			t.Fatalf("haiku %q of %d parsed as %d", h, n, got)
+		}
+	}
+
+	if n, err := ParseHaiku("  " + strings.ToUpper(ToHaiku(1234)) + "\n"); err != nil || n != 1234 {
+		t.Errorf("got %d, %v for the upper case haiku of 1234", n, err)
+	}
+}
+
+func TestHaikuMistyped(t *testing.T) {
+	accepted, total := 0, 0
+	for n := 0; n < DefaultSpace; n += 1009 {
+		words := strings.Split(ToHaiku(n), "-")
+
+		for i := range words {
+			mistyped := append([]string{}, words...)
+
+			// a word not in the dictionary
+			mistyped[i] = words[i] + "x"
+			if _, known := current.Digit(mistyped[i]); !known {
+				if _, err := ParseHaiku(strings.Join(mistyped, "-")); err == nil {
+					t.Errorf("%q accepted", strings.Join(mistyped, "-"))
+				}
+			}
+
+			// another word of the dictionary, caught by the checksum
+			for d := 0; d < current.Len(); d++ {
+				if mistyped[i] = current.Word(d); mistyped[i] == words[i] {
+					continue
+				}
+				total++
+				if _, err := ParseHaiku(strings.Join(mistyped, "-")); err == nil {
+					accepted++
+				}
+			}
+		}
+	}
+
+	if accepted*checks > total {
+		t.Errorf("%d of %d haikus with a wrong word accepted, want at most 1 in %d", accepted, total, checks)
+	}
+}
+
+func TestHaikuWrongLength(t *testing.T) {
+	h := ToHaiku(4321)
+	words := strings.Split(h, "-")
+
+	for _, wrong := range []string{
+		"",
+		strings.Join(words[1:], "-"),
+		strings.Join(words[:len(words)-1], "-"),
+		h + "-" + words[0],
+		words[0] + "-" + h,
+		h + "-",
+	} {
+		if n, err := ParseHaiku(wrong); err == nil {
+			t.Errorf("%q accepted as %d", wrong, n)
+		}
+		if n := FromHaiku(wrong); n != -1 {
+			t.Errorf("FromHaiku(%q) = %d, want -1", wrong, n)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package lib
+
+import "github.com/google/gopacket"
+
+// Annotator runs the estimators over the fingerprinted packets of a capture.
+// The estimates depend on the order packets are seen in, so they must be fed
+// in capture order.
+type Annotator struct {
+	TickRate *TickRateEstimator
+	Skew     *SkewEstimator
+	Offsets  *OffsetDetector
+}
+
+func NewAnnotator() *Annotator {
+	return &Annotator{
+		TickRate: NewTickRateEstimator(),
+		Skew:     NewSkewEstimator(),
+		Offsets:  NewOffsetDetector(),
+	}
+}
+
+// Annotate feeds a fingerprinted packet, with its capture time and raw TSval,
+// to the estimators and fills in the fingerprint with their results. Every
+// packet keeps a fingerprint: the Delta stands until a better estimate is
+// available.
+func (a *Annotator) Annotate(packet gopacket.Packet, fg *Fingerprint, captureMillis, tsVal uint64) {
+	a.TickRate.Annotate(packet, fg, captureMillis, tsVal)
+	a.Offsets.Annotate(packet, fg, captureMillis, tsVal)
+
+	// the skew of randomized clocks is fitted over all their flows instead
+	if !fg.Skewed {
+		a.Skew.Annotate(packet, fg, captureMillis, tsVal)
+	}
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"pcap-go/pkg/haiku"
+)
+
+// Config holds the fingerprinting settings: fine buckets tell apart more
+// hosts sharing a NAT, coarse ones are steadier on jittery links
+type Config struct {
+	Precision  uint64 // Bucket width of the Delta in ms
+	Bits       uint   // Deltas wrap around at 2^Bits
+	Dictionary string // Name or file of the haiku word list, see haiku.LoadDictionary
+}
+
+var DefaultConfig = Config{Precision: 10000, Bits: 18, Dictionary: haiku.DefaultDictionary}
+
+// config is the configuration in use, set once at startup with SetConfig
+var config = DefaultConfig
+
+// SetConfig changes the fingerprinting settings, it must be called before any
+// packet is fingerprinted
+func SetConfig(c Config) error {
+	if c.Precision == 0 {
+		return errors.New("precision must be at least 1 ms")
+	}
+	if c.Bits == 0 || c.Bits > 32 {
+		return errors.New("wrap width must be between 1 and 32 bits")
+	}
+
+	if c.Dictionary == "" {
+		c.Dictionary = haiku.DefaultDictionary
+	}
+	d, err := haiku.LoadDictionary(c.Dictionary)
+	if err != nil {
+		return err
+	}
+
+	// fingerprints are tagged with the dictionary name, not its file
+	c.Dictionary = d.Name
+	haiku.SetDictionary(d)
+
+	config = c
+	return haiku.SetSpace(int(c.Modulus()))
+}
+
+// CurrentConfig returns the settings in use
+func CurrentConfig() Config { return config }
+
+// Modulus returns the value Deltas wrap around at
+func (c Config) Modulus() uint64 { return 1 << c.Bits }
+
+// Tag returns the suffix appended to the haikus made with these settings,
+// e.g. "~5s.20" or "~10s.18.short" with another dictionary, empty for the
+// default settings so that existing haikus keep their meaning
+func (c Config) Tag() string {
+	if c == DefaultConfig {
+		return ""
+	}
+
+	tag := fmt.Sprintf("~%s.%d", time.Duration(c.Precision)*time.Millisecond, c.Bits)
+	if c.Dictionary != haiku.DefaultDictionary {
+		tag += "." + c.Dictionary
+	}
+	return tag
+}
+
+// skewTag returns the suffix appended to the haikus of skewed fingerprints,
+// e.g. "~skew" or "~5s.20.skew", so that they never match a Delta
+func (c Config) skewTag() string {
+	if tag := c.Tag(); tag != "" {
+		return tag + ".skew"
+	}
+	return "~skew"
+}
+
+// splitTag splits the text form of a fingerprint into haiku and settings tag
+func splitTag(text string) (string, string) {
+	words, tag, found := strings.Cut(strings.TrimSpace(text), "~")
+	if found {
+		tag = "~" + tag
+	}
+	return words, tag
+}
+
+// ParseFingerprint parses the text form of a fingerprint, Delta or skew based,
+// rejecting the ones made with settings other than the current ones and the
+// mistyped ones, with a suggestion when there is a single close enough
+// fingerprint
+func ParseFingerprint(text string) (Fingerprint, error) {
+	var fg Fingerprint
+
+	words, tag := splitTag(text)
+	skewed := tag == config.skewTag()
+	if tag != config.Tag() && !skewed {
+		want := config.Tag()
+		if want == "" {
+			want = "the default settings"
+		}
+		return fg, fmt.Errorf("fingerprint %q was made with different settings, expected %s", text, want)
+	}
+
+	delta, err := haiku.ParseHaiku(words)
+	if err != nil {
+		// point typos to the intended fingerprint, never guess it
+		if suggestion, cerr := haiku.Correct(words); cerr == nil {
+			return fg, fmt.Errorf("%w, did you mean %s?", err, suggestion+tag)
+		} else if errors.Is(cerr, haiku.ErrAmbiguous) {
+			return fg, fmt.Errorf("%w, %v", err, cerr)
+		}
+		return fg, err
+	}
+
+	if skewed {
+		fg.Skewed, fg.Skew = true, deltaSkew(uint64(delta))
+	} else {
+		fg.Delta = uint64(delta)
+	}
+	fg.Encoding = config.Dictionary
+	return fg, nil
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+    "fmt"
     "os"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
@@ -9,16 +10,21 @@ import (
     "errors"
     "time"
 	"math"
-    "sort"
 	"pcap-go/pkg/haiku"
 )
 
 type Fingerprint struct {
 	Delta uint64 // Delta between packet timestamp and host timestamp
+	Skew float64 // Clock skew of the host in ppm, 0 until estimated
+	Intercept float64 // Fitted offset between packet timestamp and host timestamp in ms
+	Hz uint64 // Detected TSval frequency of the host, 0 until detected (1 kHz is assumed meanwhile)
+	Mode string // ModeStable, ModeRandomized or ModeUnknown, see OffsetDetector
+	Skewed bool // Fingerprinted by its Skew, in skewPrecision steps, instead of the Delta, for randomized hosts
+	Encoding string // Name of the dictionary the haiku is written with, see Config
+	clock uint64 // TSval clock of the host, see TickRateEstimator
 	haiku string
 }
 
-var precision uint64 = 10000
 
 // Haiku returns a haiku string representation of the fingerprint
 func (fg Fingerprint) Haiku() string {
@@ -29,19 +35,61 @@ func (fg Fingerprint) Haiku() string {
 }
 
 func (fg Fingerprint) generateHaiku() string {
-	return haiku.ToHaiku(int(fg.Delta))
+	if fg.Skewed {
+		return haiku.ToHaiku(int(fg.key())) + config.skewTag()
+	}
+	return haiku.ToHaiku(int(fg.key())) + config.Tag()
+}
+
+// key returns the value the haiku encodes: the Delta, or the quantized Skew
+// of skewed fingerprints
+func (fg Fingerprint) key() uint64 {
+	if fg.Skewed {
+		return skewDelta(fg.Skew)
+	}
+	return fg.Delta
 }
 
 // String returns a string representation of the fingerprint
 func (fg Fingerprint) String() string { return fg.Haiku() }
 
-func binarySearch(arr []int, num int) bool {
-    index := sort.SearchInts(arr, num)
-    return index < len(arr) && arr[index] == num
+// Details returns a short suffix with the estimates available for the
+// fingerprint, such as " 100Hz +12.3ppm", or an empty string if there are none
+func (fg Fingerprint) Details() string {
+	details := ""
+	if fg.Hz != 0 && fg.Hz != 1000 {
+		details += fmt.Sprintf(" %dHz", fg.Hz)
+	}
+	if fg.Skew != 0 {
+		details += fmt.Sprintf(" %+.1fppm", fg.Skew)
+	}
+	return details
+}
+
+// deltaDistance returns the distance between two Deltas, taking the
+// wrap-around at the modulus into account
+func deltaDistance(a, b uint64) uint64 {
+	modulus := config.Modulus()
+	d := (a%modulus + modulus - b%modulus) % modulus
+	return min(d, modulus-d)
+}
+
+// Near reports whether the two fingerprints are at most k buckets apart, so
+// that hosts whose offset sits on a bucket boundary still match. Skewed
+// fingerprints are never near Delta ones.
+func (fg Fingerprint) Near(other Fingerprint, k uint64) bool {
+	return fg.Skewed == other.Skewed && deltaDistance(fg.key(), other.key()) <= k
 }
 
-func (sample Fingerprint) ContainedIn(toMatch []string) (bool) {
-    return binarySearch(haiku.FromHaikus(toMatch), int(sample.Delta))
+// DecodeIPPacket decodes a raw IP packet, as handed over by nfqueue, picking
+// IPv4 or IPv6 (with its extension headers) from the version nibble
+func DecodeIPPacket(payload []byte) gopacket.Packet {
+	first := layers.LayerTypeIPv4
+	if len(payload) > 0 && payload[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+
+	return gopacket.NewPacket(payload, first, gopacket.Default)
 }
 
 func ExtractFingerprint(packet gopacket.Packet) (Fingerprint, uint64, uint64, error) {
@@ -60,8 +108,8 @@ func ExtractFingerprint(packet gopacket.Packet) (Fingerprint, uint64, uint64, er
 	}
 
 
-	delta := approx(uint64(packet.Metadata().Timestamp.UnixMilli())-tsVal, precision)
-	fg = Fingerprint{Delta: delta}
+	delta := approx(uint64(packet.Metadata().Timestamp.UnixMilli())-tsVal, config.Precision)
+	fg = Fingerprint{Delta: delta, Encoding: config.Dictionary}
 	return fg, uint64(packet.Metadata().Timestamp.UnixMilli()), tsVal, nil
 
 }
@@ -88,8 +136,8 @@ func ExtractFingerprintRealTime(packet gopacket.Packet, t time.Time) (Fingerprin
 
     millis := t.UnixMilli()
 
-	delta := approx(uint64(millis)-tsVal, precision)
-	fg = Fingerprint{Delta: delta}
+	delta := approx(uint64(millis)-tsVal, config.Precision)
+	fg = Fingerprint{Delta: delta, Encoding: config.Dictionary}
 	return fg, uint64(millis), tsVal, nil
 }
 
@@ -111,14 +159,14 @@ func ExtractFingerprintRealTimeFallback(packet gopacket.Packet) (Fingerprint, ui
 
     millis := time.Now().UnixMilli()
 
-	delta := approx(uint64(millis)-tsVal, precision)
-	fg = Fingerprint{Delta: delta}
+	delta := approx(uint64(millis)-tsVal, config.Precision)
+	fg = Fingerprint{Delta: delta, Encoding: config.Dictionary}
 	return fg, uint64(millis), tsVal, nil
 }
 
 
 func approx(x, n uint64) uint64 {
-	return uint64(math.Ceil(float64(x)/float64(n))) % uint64(math.Pow(2, 18))
+	return uint64(math.Ceil(float64(x)/float64(n))) % config.Modulus()
 }
 
 func ExtractTimestamps(opts []layers.TCPOption) (uint64, uint64, error) {
@@ -138,7 +186,8 @@ func ExtractTimestamps(opts []layers.TCPOption) (uint64, uint64, error) {
 	return 0, 0, errors.New("no timestamp")
 }
 
-func OpenPcapSource(path string) (*pcap.Handle, *os.File, error) {
+// OpenPcapSource opens a pcap or pcapng capture, "-" for stdin
+func OpenPcapSource(path string) (PacketReader, *os.File, error) {
 	var err error
 	var reader *os.File
 
@@ -151,7 +200,7 @@ func OpenPcapSource(path string) (*pcap.Handle, *os.File, error) {
 		}
 	}
 
-	source, err := pcap.OpenOfflineFile(reader)
+	source, err := openCapture(reader)
 	if err != nil {
         return nil, nil, err
 	}
@@ -159,7 +208,18 @@ func OpenPcapSource(path string) (*pcap.Handle, *os.File, error) {
     return source, reader, nil
 }
 
-func OpenPcapSink(path string) (*pcapgo.Writer, *os.File, error) {
+// Read timeout of live sources, lets callers check for cancellation and
+// refresh their output while no packets arrive
+const LiveReadTimeout = 500 * time.Millisecond
+
+// OpenLiveSource starts a live capture on a network interface
+func OpenLiveSource(iface string, snaplen int32, promisc bool) (*pcap.Handle, error) {
+	return pcap.OpenLive(iface, snaplen, promisc, LiveReadTimeout)
+}
+
+// OpenPcapSink creates a capture, "-" for stdout. Classic pcap sinks hold a
+// single link type, see SinkLinkType, pcapng ones (ng set) any number.
+func OpenPcapSink(path string, ng bool, linkType layers.LinkType) (PacketSink, *os.File, error) {
 	var err error
 	var writer *os.File
 
@@ -172,11 +232,19 @@ func OpenPcapSink(path string) (*pcapgo.Writer, *os.File, error) {
 		}
 	}
 
+    if ng {
+        sink, err := newNgSink(writer, 65536)
+        if err != nil {
+            return nil, nil, err
+        }
+        return sink, writer, nil
+    }
+
     sink := pcapgo.NewWriter(writer)
-	err = sink.WriteFileHeader(65536, layers.LinkTypeRaw)
+	err = sink.WriteFileHeader(65536, linkType)
 	if err != nil {
         return nil, nil, err
 	}
 
-    return sink, writer, nil
+    return pcapSink{sink, linkType}, writer, nil
 }
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// LinkTypeLinuxSLL2 is DLT_LINUX_SLL2 (276, "any" interface captures of
+// recent libpcap) as seen through gopacket, whose 8 bit link types truncate it
+const LinkTypeLinuxSLL2 = layers.LinkType(276 & 0xff)
+
+// LayerTypeLinuxSLL2 is the layer type of the Linux "cooked" v2 header
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(2000, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// slot 20 is unassigned in gopacket, nothing is overwritten
+func init() {
+	layers.LinkTypeMetadata[LinkTypeLinuxSLL2] = layers.EnumMetadata{
+		DecodeWith: gopacket.DecodeFunc(decodeLinuxSLL2),
+		Name:       "Linux SLL2",
+		LayerType:  LayerTypeLinuxSLL2,
+	}
+}
+
+// dlt returns the link type as written in capture files
+func dlt(linkType layers.LinkType) uint16 {
+	if linkType == LinkTypeLinuxSLL2 {
+		return 276
+	}
+	return uint16(linkType)
+}
+
+// LinuxSLL2 is the Linux "cooked" capture header, version 2
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	ProtocolType   layers.EthernetType
+	InterfaceIndex uint32
+	ArphrdType     uint16
+	PacketType     layers.LinuxSLLPacketType
+	Addr           net.HardwareAddr
+}
+
+const linuxSLL2Length = 20
+
+func (sll *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+func (sll *LinuxSLL2) CanDecode() gopacket.LayerClass { return LayerTypeLinuxSLL2 }
+
+func (sll *LinuxSLL2) NextLayerType() gopacket.LayerType { return sll.ProtocolType.LayerType() }
+
+func (sll *LinuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < linuxSLL2Length {
+		df.SetTruncated()
+		return errors.New("Linux SLL2 packet too small")
+	}
+
+	sll.ProtocolType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	sll.ArphrdType = binary.BigEndian.Uint16(data[8:10])
+	sll.PacketType = layers.LinuxSLLPacketType(data[10])
+	sll.Addr = net.HardwareAddr(data[12 : 12+min(int(data[11]), 8)])
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:linuxSLL2Length], Payload: data[linuxSLL2Length:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &LinuxSLL2{}
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.ProtocolType)
+}
+
+// PacketSource decodes the packets of a reader, each with its own link type
+// when the reader mixes several of them
+type PacketSource struct {
+	reader PacketReader
+}
+
+func NewPacketSource(reader PacketReader) *PacketSource {
+	return &PacketSource{reader: reader}
+}
+
+// NextPacket reads and decodes the next packet, its link type is kept in the
+// metadata for LinkTypeOf
+func (s *PacketSource) NextPacket() (gopacket.Packet, error) {
+	data, ci, err := s.NextPacketData()
+	if err != nil {
+		return nil, err
+	}
+	return DecodePacket(data, ci), nil
+}
+
+// NextPacketData reads the next packet without decoding it, so that the
+// decoding can be spread over several goroutines, see DecodePacket
+func (s *PacketSource) NextPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.reader.ReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+
+	ci, _ = withLinkType(s.reader, ci)
+	return data, ci, nil
+}
+
+// DecodePacket decodes a packet read with NextPacketData
+func DecodePacket(data []byte, ci gopacket.CaptureInfo) gopacket.Packet {
+	packet := gopacket.NewPacket(data, linkTypeIn(ci), gopacket.Default)
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	return packet
+}
+
+// withLinkType records the link type of a packet read from reader as the first
+// ancillary data of its capture info, unless the reader already did
+func withLinkType(reader PacketReader, ci gopacket.CaptureInfo) (gopacket.CaptureInfo, layers.LinkType) {
+	if len(ci.AncillaryData) > 0 {
+		if lt, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+			return ci, lt
+		}
+	}
+
+	linkType := reader.LinkType()
+	ci.AncillaryData = append([]interface{}{linkType}, ci.AncillaryData...)
+	return ci, linkType
+}
+
+// linkTypeIn returns the link type recorded by withLinkType, raw IP if none
+func linkTypeIn(ci gopacket.CaptureInfo) layers.LinkType {
+	if len(ci.AncillaryData) > 0 {
+		if lt, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+			return lt
+		}
+	}
+	return layers.LinkTypeRaw
+}
+
+// LinkTypeOf returns the link type a packet from a PacketSource was captured with
+func LinkTypeOf(packet gopacket.Packet) layers.LinkType {
+	return linkTypeIn(packet.Metadata().CaptureInfo)
+}
+
+// mixedReader is implemented by the sources which can mix link types
+type mixedReader interface {
+	LinkTypes() []layers.LinkType
+}
+
+// linkTypesOf returns the link types the packets of a source can have
+func linkTypesOf(source PacketReader) []layers.LinkType {
+	if mixed, ok := source.(mixedReader); ok {
+		return mixed.LinkTypes()
+	}
+	return []layers.LinkType{source.LinkType()}
+}
+
+// SinkLinkType returns the link type of a classic pcap sink for the packets
+// of source: the source's own, or raw IP when it mixes link types or has one
+// a classic pcap header can't hold
+func SinkLinkType(source PacketReader) layers.LinkType {
+	types := linkTypesOf(source)
+	if len(types) != 1 || types[0] == LinkTypeLinuxSLL2 {
+		return layers.LinkTypeRaw
+	}
+	return types[0]
+}
+
+// rawIP strips the link layer of a packet, leaving the IP packet
+func rawIP(packet gopacket.Packet) ([]byte, gopacket.CaptureInfo, error) {
+	ci := packet.Metadata().CaptureInfo
+
+	network := packet.NetworkLayer()
+	if network == nil {
+		return nil, ci, errors.New("packet without network layer")
+	}
+
+	data := append(append([]byte{}, network.LayerContents()...), network.LayerPayload()...)
+	ci.Length = max(len(data), ci.Length-(ci.CaptureLength-len(data)))
+	ci.CaptureLength = len(data)
+	return data, ci, nil
+}
@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"math"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// Fingerprinting modes of a TSval clock
+const (
+	ModeUnknown    = ""
+	ModeStable     = "stable"
+	ModeRandomized = "randomized"
+)
+
+const (
+	// Clocks seen in a single flow needed from a source before its single
+	// flow clocks are considered randomized
+	minOffsetFlows = 4
+	// Skew quantization (ppm) used for skew based fingerprints
+	skewPrecision = 5
+	// Standard error (ppm) below which the skew of a source is precise enough
+	// to be published as its fingerprint
+	maxSkewError = skewPrecision / 2.0
+)
+
+// flowMoments keeps the running means of a flow, to add its centered sums
+// to the pooled fit of its source
+type flowMoments struct {
+	first        tickSample
+	n            float64
+	meanX, meanY float64
+}
+
+// add returns the increments of the centered sums of squares and products
+func (m *flowMoments) add(s tickSample) (dxx, dxy, dyy float64) {
+	span, ticks := m.first.since(s)
+	x, y := float64(span), float64(ticks)
+
+	m.n++
+	dx, dy := x-m.meanX, y-m.meanY
+	m.meanX += dx / m.n
+	m.meanY += dy / m.n
+
+	return dx * (x - m.meanX), dx * (y - m.meanY), dy * (y - m.meanY)
+}
+
+// pooledFit fits one slope to the TSval ticks against capture time of all the
+// flows of a source, each with its own offset: randomization changes the
+// offset on every flow, never the rate of the clock
+type pooledFit struct {
+	n, flows      float64
+	sxx, sxy, syy float64
+}
+
+func (f *pooledFit) add(other pooledFit) {
+	f.n += other.n
+	f.flows += other.flows
+	f.sxx += other.sxx
+	f.sxy += other.sxy
+	f.syy += other.syy
+}
+
+func (f *pooledFit) sub(other pooledFit) {
+	f.add(pooledFit{-other.n, -other.flows, -other.sxx, -other.sxy, -other.syy})
+}
+
+// estimate returns the TSval rate, the skew and its standard error (ppm)
+func (f *pooledFit) estimate() (uint64, float64, float64, bool) {
+	dof := f.n - f.flows - 1
+	if dof < minSkewSamples || f.sxx == 0 {
+		return 0, 0, 0, false
+	}
+
+	slope := f.sxy / f.sxx // ticks per ms
+	hz := snapTickRate(slope * 1000)
+	if hz == 0 {
+		return 0, 0, 0, false
+	}
+
+	// TSvals are whole ticks: the residuals can't be trusted below the
+	// variance of their rounding, or short flows would look precise
+	rss := max(f.syy-slope*f.sxy, 0)
+	stderr := math.Sqrt(max(rss/dof, 1.0/12) / f.sxx)
+
+	ppm := 1000 / float64(hz) * 1e6
+	return hz, (slope*1000/float64(hz) - 1) * 1e6, stderr * ppm, true
+}
+
+type offsetStats struct {
+	single int // clocks seen in a single flow so far
+
+	fit       pooledFit // over the flows of the single flow clocks
+	published bool
+	bucket    int64 // published skew, in skewPrecision steps
+}
+
+// clockFlow is a TSval clock of a source along with the flow it was first
+// seen in. Until the clock shows up in another flow, the flow is fitted with
+// the ones of the other single flow clocks of the source.
+type clockFlow struct {
+	flow    flowKey
+	shared  bool // seen in several flows
+	moments flowMoments
+	fit     pooledFit // share of the flow in the fit of the source
+}
+
+// skew returns the TSval rate and the published skew of the source, which
+// moves only when the estimate leaves its step by more than a step, so that
+// the fingerprint doesn't flicker between neighbouring values
+func (s *offsetStats) skew() (uint64, float64, bool) {
+	hz, skew, stderr, ok := s.fit.estimate()
+	if !ok || stderr > maxSkewError {
+		return hz, float64(s.bucket) * skewPrecision, ok && s.published
+	}
+
+	if !s.published || math.Abs(skew-float64(s.bucket)*skewPrecision) > skewPrecision {
+		s.bucket, s.published = int64(math.Round(skew/skewPrecision)), true
+	}
+	return hz, float64(s.bucket) * skewPrecision, true
+}
+
+// OffsetDetector checks whether the TSval clocks of a source keep going
+// across flows, as stable clocks do, or whether the source starts a new one
+// on every flow, as with Linux per-connection randomization
+// (net.ipv4.tcp_timestamps=1). The mode is decided per clock, so that a host
+// with a stable clock keeps its Delta when it shares a NAT address with
+// randomized ones. The flows of randomized clocks fall back to a skew based
+// fingerprint, the skew being fitted over all the single flow clocks of the
+// source.
+//
+// The first flow of a host can't be told apart from a randomized one: on an
+// address with randomized hosts it counts as randomized until the host opens
+// another flow. The skew of several randomized hosts sharing an address is a
+// mix of their clocks.
+type OffsetDetector struct {
+	mu      sync.Mutex
+	clocks  *recentMap[uint64, *clockFlow]
+	sources *recentMap[string, *offsetStats]
+}
+
+func NewOffsetDetector() *OffsetDetector {
+	return &OffsetDetector{
+		clocks:  newRecentMap[uint64, *clockFlow](maxTickFlows),
+		sources: newRecentMap[string, *offsetStats](maxTickFlows),
+	}
+}
+
+// Observe records a packet of the flow carrying the given TSval clock, see
+// TickRateEstimator, and returns the mode of the clock
+func (d *OffsetDetector) Observe(source string, network, transport gopacket.Flow, clock, captureMillis, tsVal uint64) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, found := d.sources.get(source)
+	if !found {
+		stats = &offsetStats{}
+		d.sources.put(source, stats)
+	}
+
+	sample := tickSample{captureMillis, tsVal}
+	key := flowKey{network, transport}
+	c, found := d.clocks.get(clock)
+	if !found {
+		c = &clockFlow{flow: key, moments: flowMoments{first: sample}}
+		c.fit.flows = 1
+		stats.fit.flows++
+		stats.single++
+		d.clocks.put(clock, c)
+	} else if !c.shared && c.flow != key {
+		// not randomized after all, its flow leaves the skew fit
+		c.shared = true
+		stats.single--
+		stats.fit.sub(c.fit)
+	}
+
+	if c.shared {
+		return ModeStable
+	}
+
+	dxx, dxy, dyy := c.moments.add(sample)
+	added := pooledFit{n: 1, sxx: dxx, sxy: dxy, syy: dyy}
+	c.fit.add(added)
+	stats.fit.add(added)
+
+	if stats.single < minOffsetFlows {
+		return ModeUnknown
+	}
+	return ModeRandomized
+}
+
+// Skew returns the TSval rate and the published skew (ppm) of the randomized
+// clocks of a source, ok is false until the skew is precise enough
+func (d *OffsetDetector) Skew(source string) (uint64, float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if stats, found := d.sources.get(source); found {
+		return stats.skew()
+	}
+
+	return 0, 0, false
+}
+
+// skewDelta quantizes a skew in ppm to the Delta space
+func skewDelta(skew float64) uint64 {
+	modulus := int64(config.Modulus())
+	return uint64((int64(math.Round(skew/skewPrecision))%modulus + modulus) % modulus)
+}
+
+// deltaSkew is the inverse of skewDelta
+func deltaSkew(delta uint64) float64 {
+	modulus := config.Modulus()
+	steps := int64(delta % modulus)
+	if delta%modulus >= modulus/2 {
+		steps -= int64(modulus)
+	}
+	return float64(steps) * skewPrecision
+}
+
+// Annotate records the mode of the packet's TSval clock on the fingerprint.
+// The Delta of randomized clocks changes on every flow, so once the skew of
+// the source is precise enough their fingerprint becomes skew based, see
+// Skewed, until then they keep their Delta. The TSval clock must be known,
+// see TickRateEstimator.
+func (d *OffsetDetector) Annotate(packet gopacket.Packet, fg *Fingerprint, captureMillis, tsVal uint64) {
+	if packet.NetworkLayer() == nil || packet.TransportLayer() == nil {
+		return
+	}
+
+	network := packet.NetworkLayer().NetworkFlow()
+	transport := packet.TransportLayer().TransportFlow()
+	source := network.Src().String()
+
+	fg.Mode = d.Observe(source, network, transport, fg.clock, captureMillis, tsVal)
+	if fg.Mode != ModeRandomized {
+		return
+	}
+
+	if hz, skew, ok := d.Skew(source); ok {
+		fg.Hz, fg.Skew, fg.Intercept = hz, skew, 0
+		fg.Skewed = true
+		fg.haiku = ""
+	}
+}
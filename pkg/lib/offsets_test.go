@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestOffsetsNATMix(t *testing.T) {
+	a := NewAnnotator()
+	rng := rand.New(rand.NewSource(1))
+	stable := testHost{src: "10.60.5.2", hz: 1000, skew: -30, boot: testBoot}
+	randomized := testHost{src: "10.60.5.2", hz: 1000, skew: 40, boot: testBoot.Add(-time.Hour)}
+
+	var skewed []Fingerprint
+	for i := 0; i < 20; i++ {
+		start := testStart.Add(time.Duration(i) * time.Minute)
+		fgs, plain := testFlow(t, a, stable, uint16(40000+i), start, 2*time.Second, 200*time.Millisecond)
+		for j, fg := range fgs {
+			if i > 0 && (fg.Haiku() != plain[j].Haiku() || fg.Mode != ModeStable) {
+				t.Errorf("stable flow %d: got %s (%s), want %s (stable)", i, fg.Haiku(), fg.Mode, plain[j].Haiku())
+			}
+		}
+
+		randomized.offset = rng.Uint32()
+		fgs, plain = testFlow(t, a, randomized, uint16(50000+i), start.Add(10*time.Second), 20*time.Second, 200*time.Millisecond)
+		for j, fg := range fgs {
+			switch {
+			case fg.Skewed:
+				skewed = append(skewed, fg)
+			case fg.Haiku() != plain[j].Haiku():
+				t.Errorf("randomized flow %d: got %s before the skew is known, want the Delta %s", i, fg.Haiku(), plain[j].Haiku())
+			}
+			if i >= minOffsetFlows && fg.Mode != ModeRandomized {
+				t.Errorf("randomized flow %d: got mode %q", i, fg.Mode)
+			}
+		}
+	}
+
+	if len(skewed) == 0 {
+		t.Fatal("skew of the randomized host never published")
+	}
+	for _, fg := range skewed {
+		if fg.Haiku() != skewed[0].Haiku() || math.Abs(fg.Skew-randomized.skew) > skewPrecision {
+			t.Errorf("got %s (%+.0fppm), want a single skew fingerprint at %+.0fppm", fg.Haiku(), fg.Skew, randomized.skew)
+		}
+	}
+}
+
+func TestOffsetsShortRandomizedFlows(t *testing.T) {
+	a := NewAnnotator()
+	rng := rand.New(rand.NewSource(1))
+	h := testHost{src: "10.60.6.2", hz: 1000, skew: 40, boot: testBoot}
+
+	for i := 0; i < 400; i++ {
+		h.offset = rng.Uint32()
+		fgs, plain := testFlow(t, a, h, uint16(40000+i), testStart.Add(time.Duration(i)*5*time.Second), 450*time.Millisecond, 100*time.Millisecond)
+		for j, fg := range fgs {
+			// too short for the skew to be measured, the Delta stands
+			if fg.Skewed || fg.Haiku() != plain[j].Haiku() {
+				t.Fatalf("flow %d: got %s, want the Delta %s", i, fg.Haiku(), plain[j].Haiku())
+			}
+			if i >= minOffsetFlows && fg.Mode != ModeRandomized {
+				t.Fatalf("flow %d: got mode %q", i, fg.Mode)
+			}
+		}
+	}
+}
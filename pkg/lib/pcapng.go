@@ -0,0 +1,302 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// PacketReader is a capture packets are read from, a file or an interface
+type PacketReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// magic of the pcapng section header block, the same in both byte orders
+const pcapngMagic = 0x0A0D0D0A
+
+// openCapture reads a pcap or pcapng capture, telling them apart by their magic
+func openCapture(r io.Reader) (PacketReader, error) {
+	buf := bufio.NewReader(r)
+
+	magic, err := buf.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		options := pcapgo.DefaultNgReaderOptions
+		options.WantMixedLinkType = true
+		reader, err := pcapgo.NewNgReader(buf, options)
+		if err != nil {
+			return nil, err
+		}
+		return ngReader{reader}, nil
+	}
+
+	return pcapgo.NewReader(buf)
+}
+
+// ngReader reads pcapng captures, whose interfaces can have different link types
+type ngReader struct {
+	*pcapgo.NgReader
+}
+
+// LinkTypes returns the link types of the interfaces seen so far
+func (r ngReader) LinkTypes() []layers.LinkType {
+	var types []layers.LinkType
+	for i := 0; i < r.NInterfaces(); i++ {
+		intf, _ := r.Interface(i)
+		if !slices.Contains(types, intf.LinkType) {
+			types = append(types, intf.LinkType)
+		}
+	}
+	return types
+}
+
+// bpfReader drops the packets not matching a BPF filter, for the sources
+// libpcap doesn't filter itself. The filter is compiled for each link type,
+// except Linux SLL2: gopacket can't hand its 16 bit DLT to libpcap, so its
+// IP packets are filtered as raw IPv4 or IPv6 and the others never match.
+type bpfReader struct {
+	PacketReader
+	expr    string
+	filters map[layers.LinkType]*pcap.BPF
+}
+
+func (r *bpfReader) filter(linkType layers.LinkType) (*pcap.BPF, error) {
+	filter, found := r.filters[linkType]
+	if !found {
+		var err error
+		filter, err = pcap.NewBPF(linkType, 65536, r.expr)
+		if err != nil {
+			return nil, err
+		}
+		r.filters[linkType] = filter
+	}
+	return filter, nil
+}
+
+func (r *bpfReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := r.PacketReader.ReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+
+		ci, linkType := withLinkType(r.PacketReader, ci)
+
+		matchData, matchCi := data, ci
+		if linkType == LinkTypeLinuxSLL2 {
+			var ok bool
+			if matchData, matchCi, linkType, ok = sll2IP(data, ci); !ok {
+				continue
+			}
+		}
+
+		filter, err := r.filter(linkType)
+		if err != nil {
+			return nil, ci, err
+		}
+		if filter.Matches(matchCi, matchData) {
+			return data, ci, nil
+		}
+	}
+}
+
+// sll2IP strips the Linux SLL2 header of an IP packet, returning the link
+// type to filter it with, false for the other protocols
+func sll2IP(data []byte, ci gopacket.CaptureInfo) ([]byte, gopacket.CaptureInfo, layers.LinkType, bool) {
+	if len(data) < linuxSLL2Length {
+		return nil, ci, 0, false
+	}
+
+	var linkType layers.LinkType
+	switch layers.EthernetType(binary.BigEndian.Uint16(data[0:2])) {
+	case layers.EthernetTypeIPv4:
+		linkType = layers.LinkTypeIPv4
+	case layers.EthernetTypeIPv6:
+		linkType = layers.LinkTypeIPv6
+	default:
+		return nil, ci, 0, false
+	}
+
+	ci.CaptureLength -= linuxSLL2Length
+	ci.Length -= linuxSLL2Length
+	return data[linuxSLL2Length:], ci, linkType, true
+}
+
+func (r *bpfReader) LinkTypes() []layers.LinkType { return linkTypesOf(r.PacketReader) }
+
+// FilterSource applies a BPF filter to a source, an empty one matches everything
+func FilterSource(source PacketReader, expr string) (PacketReader, error) {
+	if handle, ok := source.(*pcap.Handle); ok {
+		return handle, handle.SetBPFFilter(expr)
+	}
+
+	if expr == "" {
+		return source, nil
+	}
+
+	r := &bpfReader{PacketReader: source, expr: expr, filters: make(map[layers.LinkType]*pcap.BPF)}
+
+	// report syntax errors right away
+	linkType := source.LinkType()
+	if linkType == LinkTypeLinuxSLL2 {
+		linkType = layers.LinkTypeIPv4
+	}
+	if _, err := r.filter(linkType); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// PacketSink is a capture matched packets are written to, the comment is
+// kept by the formats supporting it
+type PacketSink interface {
+	WritePacket(packet gopacket.Packet, comment string) error
+	Flush() error
+}
+
+// pcapSink writes classic pcap, which has no room for comments and holds a
+// single link type: the packets are converted to raw IP when it is raw
+type pcapSink struct {
+	w        *pcapgo.Writer
+	linkType layers.LinkType
+}
+
+func (s pcapSink) WritePacket(packet gopacket.Packet, comment string) error {
+	if linkType := LinkTypeOf(packet); linkType != s.linkType {
+		if s.linkType != layers.LinkTypeRaw {
+			return fmt.Errorf("can't write a %s packet to a %s capture", linkType, s.linkType)
+		}
+
+		data, ci, err := rawIP(packet)
+		if err != nil {
+			return err
+		}
+		return s.w.WritePacket(ci, data)
+	}
+
+	return s.w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+}
+
+func (s pcapSink) Flush() error { return nil }
+
+// pcapng block types and options
+const (
+	ngInterfaceBlock      = 1
+	ngEnhancedPacketBlock = 6
+	ngEndOfOptions        = 0
+	ngComment             = 1
+	ngTimestampResolution = 9
+)
+
+// ngSink writes pcapng, with the comment of each packet as its opt_comment
+// and an interface for each link type. pcapgo's NgWriter can't write packet
+// options, hence this minimal writer.
+type ngSink struct {
+	w          *bufio.Writer
+	snaplen    uint32
+	interfaces map[layers.LinkType]uint32
+}
+
+func newNgSink(w io.Writer, snaplen uint32) (*ngSink, error) {
+	s := &ngSink{w: bufio.NewWriter(w), snaplen: snaplen, interfaces: make(map[layers.LinkType]uint32)}
+
+	// section header: byte order magic, version 1.0, unknown section length
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	if err := s.writeBlock(pcapngMagic, shb, nil); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// intf returns the interface of a link type, describing it on first use
+func (s *ngSink) intf(linkType layers.LinkType) (uint32, error) {
+	if id, found := s.interfaces[linkType]; found {
+		return id, nil
+	}
+
+	// nanosecond timestamps
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], dlt(linkType))
+	binary.LittleEndian.PutUint32(idb[4:8], s.snaplen)
+	options := ngOption(nil, ngTimestampResolution, []byte{9})
+	if err := s.writeBlock(ngInterfaceBlock, idb, options); err != nil {
+		return 0, err
+	}
+
+	id := uint32(len(s.interfaces))
+	s.interfaces[linkType] = id
+	return id, nil
+}
+
+// ngOption appends an option, padded to 32 bits, to a list of options
+func ngOption(options []byte, code uint16, value []byte) []byte {
+	options = binary.LittleEndian.AppendUint16(options, code)
+	options = binary.LittleEndian.AppendUint16(options, uint16(len(value)))
+	options = append(options, value...)
+	return append(options, make([]byte, ngPadding(len(value)))...)
+}
+
+func ngPadding(n int) int { return (4 - n%4) % 4 }
+
+// writeBlock writes a block, its body must already be padded
+func (s *ngSink) writeBlock(blockType uint32, body []byte, options []byte) error {
+	if len(options) > 0 {
+		options = ngOption(options, ngEndOfOptions, nil)
+	}
+	length := uint32(12 + len(body) + len(options))
+
+	header := binary.LittleEndian.AppendUint32(nil, blockType)
+	header = binary.LittleEndian.AppendUint32(header, length)
+
+	for _, part := range [][]byte{header, body, options, binary.LittleEndian.AppendUint32(nil, length)} {
+		if _, err := s.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ngSink) WritePacket(packet gopacket.Packet, comment string) error {
+	ci, data := packet.Metadata().CaptureInfo, packet.Data()
+
+	id, err := s.intf(LinkTypeOf(packet))
+	if err != nil {
+		return err
+	}
+
+	ts := uint64(ci.Timestamp.UnixNano())
+
+	body := make([]byte, 20, 20+len(data)+ngPadding(len(data)))
+	binary.LittleEndian.PutUint32(body[0:4], id)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(max(ci.Length, len(data))))
+	body = append(body, data...)
+	body = append(body, make([]byte, ngPadding(len(data)))...)
+
+	var options []byte
+	if comment != "" {
+		options = ngOption(options, ngComment, []byte(comment))
+	}
+
+	return s.writeBlock(ngEnhancedPacketBlock, body, options)
+}
+
+func (s *ngSink) Flush() error { return s.w.Flush() }
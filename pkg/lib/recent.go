@@ -0,0 +1,37 @@
+package lib
+
+// recentMap is a map holding at most size entries which forgets the least
+// recently used ones first: entries live in two generations, and the older
+// one is dropped when the current one is full. A flood of new keys only
+// evicts the keys left untouched for a whole generation, instead of wiping
+// the table along with the hosts being measured.
+type recentMap[K comparable, V any] struct {
+	size      int
+	cur, prev map[K]V
+}
+
+func newRecentMap[K comparable, V any](size int) *recentMap[K, V] {
+	return &recentMap[K, V]{size: size, cur: make(map[K]V), prev: make(map[K]V)}
+}
+
+// get returns the value of a key, marking it as recently used
+func (m *recentMap[K, V]) get(key K) (V, bool) {
+	if value, found := m.cur[key]; found {
+		return value, true
+	}
+
+	value, found := m.prev[key]
+	if found {
+		m.put(key, value)
+	}
+	return value, found
+}
+
+// put sets the value of a key, marking it as recently used
+func (m *recentMap[K, V]) put(key K, value V) {
+	if _, found := m.cur[key]; !found && len(m.cur) >= m.size/2 {
+		m.prev, m.cur = m.cur, make(map[K]V)
+	}
+	m.cur[key] = value
+	delete(m.prev, key)
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"slices"
+	"strings"
+)
+
+// FingerprintSet is a set of fingerprints made with the current settings,
+// parsed once so that matching a packet is a single lookup, or a binary
+// search with a tolerance
+type FingerprintSet struct {
+	tolerance uint64
+	keys      map[setKey]struct{}
+	sorted    map[bool][]uint64 // member values in order, for skewed fingerprints or not
+	size      int
+}
+
+// setKey is the value a haiku encodes, Delta or quantized skew
+type setKey struct {
+	skewed bool
+	value  uint64
+}
+
+// NewFingerprintSet returns an empty set which also matches the fingerprints
+// at most tolerance buckets away from its members
+func NewFingerprintSet(tolerance uint64) *FingerprintSet {
+	return &FingerprintSet{tolerance: tolerance, keys: make(map[setKey]struct{}), sorted: make(map[bool][]uint64)}
+}
+
+// ParseFingerprintSet parses a list of fingerprints, skipping empty entries
+func ParseFingerprintSet(texts []string, tolerance uint64) (*FingerprintSet, error) {
+	set := NewFingerprintSet(tolerance)
+	for _, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if err := set.Add(text); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Add parses a fingerprint and inserts it
+func (s *FingerprintSet) Add(text string) error {
+	fg, err := ParseFingerprint(text)
+	if err != nil {
+		return err
+	}
+
+	key := setKey{fg.Skewed, fg.key() % config.Modulus()}
+	if _, found := s.keys[key]; !found {
+		s.keys[key] = struct{}{}
+		values := s.sorted[key.skewed]
+		i, _ := slices.BinarySearch(values, key.value)
+		s.sorted[key.skewed] = slices.Insert(values, i, key.value)
+	}
+
+	s.size++
+	return nil
+}
+
+// Contains reports whether the fingerprint is in the set, or within the
+// tolerance of a member, wrapping around at the modulus
+func (s *FingerprintSet) Contains(fg Fingerprint) bool {
+	key := setKey{fg.Skewed, fg.key() % config.Modulus()}
+	if _, found := s.keys[key]; found || s.tolerance == 0 {
+		return found
+	}
+
+	values := s.sorted[key.skewed]
+	if len(values) == 0 {
+		return false
+	}
+
+	// the nearest members are the ones around the value, the last and the
+	// first ones across the wrap-around
+	i, _ := slices.BinarySearch(values, key.value)
+	next, prev := values[i%len(values)], values[(i+len(values)-1)%len(values)]
+	return deltaDistance(next, key.value) <= s.tolerance || deltaDistance(prev, key.value) <= s.tolerance
+}
+
+// Len returns the number of fingerprints added
+func (s *FingerprintSet) Len() int { return s.size }
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"pcap-go/pkg/haiku"
+)
+
+// Size of a typical -F list
+const benchSetSize = 100
+
+// benchFingerprints returns the haikus of a -F list and fingerprints to look
+// up in it, half of them members
+func benchFingerprints() ([]string, []Fingerprint) {
+	rng := rand.New(rand.NewSource(1))
+	modulus := config.Modulus()
+
+	list := make([]string, benchSetSize)
+	lookups := make([]Fingerprint, 2*benchSetSize)
+	for i := range list {
+		member := Fingerprint{Delta: rng.Uint64() % modulus}
+		list[i] = member.Haiku()
+		lookups[2*i] = member
+		lookups[2*i+1] = Fingerprint{Delta: rng.Uint64() % modulus}
+	}
+	return list, lookups
+}
+
+// containedIn is the matching done before FingerprintSet, parsing the whole
+// list for every packet
+func containedIn(sample Fingerprint, toMatch []string) bool {
+	stripped := make([]string, 0, len(toMatch))
+	for _, text := range toMatch {
+		if words, tag := splitTag(text); tag == config.Tag() {
+			stripped = append(stripped, words)
+		}
+	}
+
+	arr := haiku.FromHaikus(stripped)
+	index := sort.SearchInts(arr, int(sample.Delta))
+	return index < len(arr) && arr[index] == int(sample.Delta)
+}
+
+func BenchmarkFingerprintSetContains(b *testing.B) {
+	list, lookups := benchFingerprints()
+	set, err := ParseFingerprintSet(list, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Contains(lookups[i%len(lookups)])
+	}
+}
+
+func BenchmarkFingerprintSetContainsTolerance(b *testing.B) {
+	list, lookups := benchFingerprints()
+	set, err := ParseFingerprintSet(list, 3)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Contains(lookups[i%len(lookups)])
+	}
+}
+
+func BenchmarkContainedIn(b *testing.B) {
+	list, lookups := benchFingerprints()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		containedIn(lookups[i%len(lookups)], list)
+	}
+}
+
+// setConfig changes the settings for the test, restoring the default ones
+// after it
+func setConfig(t *testing.T, c Config) {
+	t.Helper()
+	if err := SetConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetConfig(DefaultConfig) })
+}
+
+func TestFingerprintSetTolerance(t *testing.T) {
+	// a small modulus, so that members sit across the wrap-around
+	setConfig(t, Config{Precision: 10000, Bits: 6})
+	modulus := config.Modulus()
+	rng := rand.New(rand.NewSource(1))
+
+	for _, tolerance := range []uint64{0, 1, 3, modulus / 2, modulus} {
+		members := []Fingerprint{{Delta: 0}, {Delta: modulus - 2}}
+		for i := 0; i < 4; i++ {
+			members = append(members, Fingerprint{Delta: rng.Uint64() % modulus})
+		}
+		members = append(members, Fingerprint{Skewed: true, Skew: 20})
+
+		set := NewFingerprintSet(tolerance)
+		for _, member := range members {
+			if err := set.Add(member.Haiku()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for delta := uint64(0); delta < modulus; delta++ {
+			for _, fg := range []Fingerprint{{Delta: delta}, {Skewed: true, Skew: deltaSkew(delta)}} {
+				want := false
+				for _, member := range members {
+					want = want || fg.Near(member, tolerance)
+				}
+				if got := set.Contains(fg); got != want {
+					t.Errorf("tolerance %d: %s contained %v, want %v", tolerance, fg, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFingerprintSetLargeTolerance(t *testing.T) {
+	setConfig(t, Config{Precision: 10000, Bits: 32})
+
+	// members used to be expanded into every key within the tolerance
+	set := NewFingerprintSet(1 << 31)
+	if err := set.Add(Fingerprint{Delta: 12345}.Haiku()); err != nil {
+		t.Fatal(err)
+	}
+	if !set.Contains(Fingerprint{Delta: 12345 + 1<<30}) {
+		t.Error("fingerprint within the tolerance not contained")
+	}
+}
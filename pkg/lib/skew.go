@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// Minimum number of samples and time span (ms) before a skew fit is trusted
+const (
+	minSkewSamples = 3
+	minSkewSpan    = 1000
+)
+
+// skewFit accumulates the sums of an ordinary least squares fit of TSval
+// ticks against capture time, relative to the first sample seen for a clock
+// ticking at hz
+type skewFit struct {
+	hz         uint64
+	refCapture uint64
+	refTsVal   uint64
+
+	n                        float64
+	sumX, sumY, sumXX, sumXY float64
+	minX, maxX               float64
+}
+
+func (f *skewFit) add(captureMillis, tsVal uint64) {
+	x, y := tickSample{f.refCapture, f.refTsVal}.since(tickSample{captureMillis, tsVal})
+
+	f.n++
+	f.sumX += float64(x)
+	f.sumY += float64(y)
+	f.sumXX += float64(x) * float64(x)
+	f.sumXY += float64(x) * float64(y)
+	f.minX = min(f.minX, float64(x))
+	f.maxX = max(f.maxX, float64(x))
+}
+
+// estimate returns the skew in ppm and the fitted offset (capture - TSval)
+// in ms at the reference capture time
+func (f *skewFit) estimate() (float64, float64, bool) {
+	if f.n < minSkewSamples || f.maxX-f.minX < minSkewSpan {
+		return 0, 0, false
+	}
+
+	den := f.n*f.sumXX - f.sumX*f.sumX
+	if den == 0 {
+		return 0, 0, false
+	}
+
+	// in ticks per ms and ticks
+	slope := (f.n*f.sumXY - f.sumX*f.sumY) / den
+	intercept := (f.sumY - slope*f.sumX) / f.n
+
+	msPerTick := 1000 / float64(f.hz)
+	skew := (slope*msPerTick - 1) * 1e6
+	offset := float64(f.refCapture) - (float64(f.refTsVal)+intercept)*msPerTick
+	return skew, offset, true
+}
+
+// SkewEstimator fits a line to the (capture time, TSval) pairs of each key,
+// the same fit plotter-presentazione/plot_utils.py does, to estimate the
+// clock rate of a host. Annotate keys the fits by TSval clock rather than by
+// address, so that the hosts sharing a NAT address get a fit each instead of
+// one mixing their clocks.
+type SkewEstimator struct {
+	mu   sync.Mutex
+	fits *recentMap[string, *skewFit]
+}
+
+func NewSkewEstimator() *SkewEstimator {
+	return &SkewEstimator{fits: newRecentMap[string, *skewFit](maxTickFlows)}
+}
+
+// Add records a sample for the given key, whose TSval ticks at hz, and
+// returns the updated skew (ppm) and intercept (ms), ok is false until enough
+// samples have been collected. The fit starts over if the rate changes.
+func (e *SkewEstimator) Add(key string, hz, captureMillis, tsVal uint64) (float64, float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fit, found := e.fits.get(key)
+	if !found || fit.hz != hz {
+		fit = &skewFit{hz: hz, refCapture: captureMillis, refTsVal: tsVal}
+		e.fits.put(key, fit)
+	}
+
+	fit.add(captureMillis, tsVal)
+	return fit.estimate()
+}
+
+// Estimate returns the current skew (ppm) and intercept (ms) of a key
+func (e *SkewEstimator) Estimate(key string) (float64, float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fit, found := e.fits.get(key)
+	if !found {
+		return 0, 0, false
+	}
+
+	return fit.estimate()
+}
+
+// Annotate feeds the packet to the estimator, keyed by its source address and
+// TSval clock, and fills in the Skew and Intercept fields of the fingerprint.
+// The clock and its rate must be known, see TickRateEstimator.
+func (e *SkewEstimator) Annotate(packet gopacket.Packet, fg *Fingerprint, captureMillis, tsVal uint64) {
+	if packet.NetworkLayer() == nil || fg.Hz == 0 {
+		return
+	}
+
+	key := fmt.Sprintf("%s#%d", packet.NetworkLayer().NetworkFlow().Src(), fg.clock)
+	if skew, intercept, ok := e.Add(key, fg.Hz, captureMillis, tsVal); ok {
+		fg.Skew = skew
+		fg.Intercept = intercept
+	}
+}
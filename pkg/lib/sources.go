@@ -0,0 +1,415 @@
+package lib
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Extensions of the captures picked from directories
+var captureExtensions = []string{".pcap", ".pcapng", ".cap"}
+
+func isCapture(name string) bool {
+	return !strings.HasPrefix(name, ".") && slices.Contains(captureExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// capturesIn lists the captures of a directory, sorted by name
+func capturesIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isCapture(entry.Name()) {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// ExpandCaptures turns a list of files, globs and directories into the list
+// of captures they name, without duplicates
+func ExpandCaptures(args []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+
+	add := func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		found := []string{path}
+		if info.IsDir() {
+			if found, err = capturesIn(path); err != nil {
+				return err
+			}
+		}
+
+		for _, path := range found {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+		return nil
+	}
+
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			// not a pattern, let Stat report the missing file
+			matches = []string{arg}
+		}
+
+		for _, match := range matches {
+			if err := add(match); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no captures found in %s", strings.Join(args, " "))
+	}
+	return paths, nil
+}
+
+// capture is a file being merged, with its next packet read ahead
+type capture struct {
+	path   string
+	first  time.Time
+	file   *os.File
+	reader PacketReader
+	data   []byte
+	ci     gopacket.CaptureInfo
+}
+
+// next reads ahead the next packet of the capture
+func (c *capture) next() error {
+	data, ci, err := c.reader.ReadPacketData()
+	if err != nil {
+		return err
+	}
+
+	c.data = data
+	c.ci, _ = withLinkType(c.reader, ci)
+	return nil
+}
+
+func (c *capture) open() error {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+
+	reader, err := openCapture(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	c.file, c.reader = file, reader
+	return nil
+}
+
+func (c *capture) close() {
+	if c.file != nil {
+		c.file.Close()
+		c.file, c.reader, c.data = nil, nil, nil
+	}
+}
+
+// captureHeap orders the open captures by their next packet
+type captureHeap []*capture
+
+func (h captureHeap) Len() int           { return len(h) }
+func (h captureHeap) Less(i, j int) bool { return h[i].ci.Timestamp.Before(h[j].ci.Timestamp) }
+func (h captureHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *captureHeap) Push(x any)        { *h = append(*h, x.(*capture)) }
+func (h *captureHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// MergedSource reads several captures as one, in timestamp order. A capture
+// is only kept open while its packets overlap with the ones being read, so
+// that rotated captures don't run out of file descriptors.
+type MergedSource struct {
+	pending   []*capture // by first packet, not opened yet
+	open      captureHeap
+	linkTypes []layers.LinkType
+	err       error // of a capture that failed after its last packet was read
+}
+
+// OpenMergedSource opens the given captures, reading their first packet to
+// sort them. Empty captures are skipped.
+func OpenMergedSource(paths []string) (*MergedSource, error) {
+	m := &MergedSource{}
+
+	for _, path := range paths {
+		c := &capture{path: path}
+		if err := c.open(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		err := c.next()
+		for _, linkType := range linkTypesOf(c.reader) {
+			if !slices.Contains(m.linkTypes, linkType) {
+				m.linkTypes = append(m.linkTypes, linkType)
+			}
+		}
+		c.first = c.ci.Timestamp
+		c.close()
+
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		m.pending = append(m.pending, c)
+	}
+
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		return m.pending[i].first.Before(m.pending[j].first)
+	})
+
+	return m, nil
+}
+
+func (m *MergedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if err := m.err; err != nil {
+		m.err = nil
+		return nil, gopacket.CaptureInfo{}, err
+	}
+
+	// open the captures starting before the next packet
+	for len(m.pending) > 0 && (len(m.open) == 0 || !m.pending[0].first.After(m.open[0].ci.Timestamp)) {
+		c := m.pending[0]
+		m.pending = m.pending[1:]
+
+		err := c.open()
+		if err == nil {
+			err = c.next()
+		}
+		if err != nil {
+			c.close()
+			if err == io.EOF {
+				continue
+			}
+			return nil, gopacket.CaptureInfo{}, fmt.Errorf("%s: %w", c.path, err)
+		}
+
+		heap.Push(&m.open, c)
+	}
+
+	if len(m.open) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	c := m.open[0]
+	data, ci := c.data, c.ci
+
+	if err := c.next(); err != nil {
+		heap.Pop(&m.open)
+		c.close()
+		if err != io.EOF {
+			m.err = fmt.Errorf("%s: %w", c.path, err)
+		}
+	} else {
+		heap.Fix(&m.open, 0)
+	}
+
+	return data, ci, nil
+}
+
+// LinkType returns the link type of the first capture
+func (m *MergedSource) LinkType() layers.LinkType {
+	if len(m.linkTypes) == 0 {
+		return layers.LinkTypeRaw
+	}
+	return m.linkTypes[0]
+}
+
+// LinkTypes returns the link types of all the captures
+func (m *MergedSource) LinkTypes() []layers.LinkType { return m.linkTypes }
+
+// Close closes the captures still open
+func (m *MergedSource) Close() {
+	for _, c := range m.open {
+		c.close()
+	}
+	m.open, m.pending = nil, nil
+}
+
+// How often followed directories are checked for new captures
+const FollowPollInterval = time.Second
+
+// FollowSource reads the captures of some directories as they appear, each
+// one once a newer capture appeared in its directory. Captures appearing
+// together are merged in timestamp order. While waiting for new captures it
+// returns pcap.NextErrorTimeoutExpired, like live sources.
+type FollowSource struct {
+	dirs      []string
+	done      map[string]bool
+	current   *MergedSource
+	lastPoll  time.Time
+	linkTypes []layers.LinkType
+}
+
+func NewFollowSource(dirs []string) (*FollowSource, error) {
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+
+	return &FollowSource{dirs: dirs, done: make(map[string]bool)}, nil
+}
+
+// poll returns the captures not read yet but the most recently modified of
+// each directory, the one still being written: tcpdump buffers its writes, so
+// a capture can stop growing for a while before being complete
+func (f *FollowSource) poll() ([]string, error) {
+	var ready []string
+	for _, dir := range f.dirs {
+		paths, err := capturesIn(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var found []string
+		var newest string
+		var newestTime time.Time
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				// rotated away
+				continue
+			}
+
+			found = append(found, path)
+			// on a tie the later name, as rotated names mostly sort in order
+			if newest == "" || !info.ModTime().Before(newestTime) {
+				newest, newestTime = path, info.ModTime()
+			}
+		}
+
+		for _, path := range found {
+			if path != newest && !f.done[path] {
+				ready = append(ready, path)
+				f.done[path] = true
+			}
+		}
+	}
+	return ready, nil
+}
+
+func (f *FollowSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if f.current != nil {
+		data, ci, err := f.current.ReadPacketData()
+		if err != io.EOF {
+			return data, ci, err
+		}
+		f.current.Close()
+		f.current = nil
+	}
+
+	if wait := FollowPollInterval - time.Since(f.lastPoll); wait > 0 {
+		time.Sleep(min(wait, LiveReadTimeout))
+		return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+	}
+	f.lastPoll = time.Now()
+
+	ready, err := f.poll()
+	if err != nil || len(ready) == 0 {
+		if err == nil {
+			err = pcap.NextErrorTimeoutExpired
+		}
+		return nil, gopacket.CaptureInfo{}, err
+	}
+
+	merged, err := OpenMergedSource(ready)
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+
+	for _, linkType := range merged.LinkTypes() {
+		if !slices.Contains(f.linkTypes, linkType) {
+			f.linkTypes = append(f.linkTypes, linkType)
+		}
+	}
+
+	f.current = merged
+	return f.ReadPacketData()
+}
+
+// LinkType returns the link type of the first capture read, Ethernet until then
+func (f *FollowSource) LinkType() layers.LinkType {
+	if len(f.linkTypes) == 0 {
+		return layers.LinkTypeEthernet
+	}
+	return f.linkTypes[0]
+}
+
+// LinkTypes returns the link types of the captures read so far
+func (f *FollowSource) LinkTypes() []layers.LinkType { return f.linkTypes }
+
+func (f *FollowSource) Close() {
+	if f.current != nil {
+		f.current.Close()
+	}
+}
+
+// windowReader drops the packets captured outside of a time window
+type windowReader struct {
+	PacketReader
+	since, until time.Time
+}
+
+func (r *windowReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := r.PacketReader.ReadPacketData()
+		if err != nil {
+			return data, ci, err
+		}
+
+		if (r.since.IsZero() || !ci.Timestamp.Before(r.since)) && (r.until.IsZero() || ci.Timestamp.Before(r.until)) {
+			return data, ci, nil
+		}
+	}
+}
+
+func (r *windowReader) LinkTypes() []layers.LinkType { return linkTypesOf(r.PacketReader) }
+
+// FilterTime drops the packets of a source captured before since or from
+// until on, a zero time leaves that side open
+func FilterTime(source PacketReader, since, until time.Time) PacketReader {
+	if since.IsZero() && until.IsZero() {
+		return source
+	}
+	return &windowReader{PacketReader: source, since: since, until: until}
+}
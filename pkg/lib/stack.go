@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// StackSignature is a p0f-style passive fingerprint of the TCP/IP stack of a
+// host, built from the fields of its SYN packets
+type StackSignature struct {
+	Version       uint8  // IP version
+	TTL           uint8  // TTL as observed
+	InitialTTL    uint8  // TTL the host most likely started with
+	DontFragment  bool   // DF bit set
+	Window        uint16 // Raw window size
+	MSS           uint16 // Maximum segment size, 0 if absent
+	WScale        int    // Window scale, -1 if absent
+	SACKPermitted bool   // SACK permitted option present
+	Timestamps    bool   // Timestamps option present
+	Options       string // Option layout, e.g. "mss,sok,ts,nop,ws"
+}
+
+// initialTTL rounds an observed TTL up to the closest common initial TTL
+func initialTTL(ttl uint8) uint8 {
+	for _, initial := range []uint8{32, 64, 128} {
+		if ttl <= initial {
+			return initial
+		}
+	}
+	return 255
+}
+
+func optionName(kind layers.TCPOptionKind) string {
+	switch kind {
+	case layers.TCPOptionKindEndList:
+		return "eol"
+	case layers.TCPOptionKindNop:
+		return "nop"
+	case layers.TCPOptionKindMSS:
+		return "mss"
+	case layers.TCPOptionKindWindowScale:
+		return "ws"
+	case layers.TCPOptionKindSACKPermitted:
+		return "sok"
+	case layers.TCPOptionKindSACK:
+		return "sack"
+	case layers.TCPOptionKindTimestamps:
+		return "ts"
+	default:
+		return fmt.Sprintf("?%d", kind)
+	}
+}
+
+// ExtractStackSignature builds the stack signature of a SYN packet from its
+// IPv4 and TCP layers
+func ExtractStackSignature(ip *layers.IPv4, tcp *layers.TCP) (StackSignature, error) {
+	if ip == nil {
+		return StackSignature{WScale: -1}, errors.New("missing IPv4 layer")
+	}
+
+	return extractStackSignature(4, ip.TTL, ip.Flags&layers.IPv4DontFragment != 0, tcp)
+}
+
+// ExtractStackSignatureV6 builds the stack signature of a SYN packet from its
+// IPv6 and TCP layers, the hop limit takes the place of the TTL
+func ExtractStackSignatureV6(ip *layers.IPv6, tcp *layers.TCP) (StackSignature, error) {
+	if ip == nil {
+		return StackSignature{WScale: -1}, errors.New("missing IPv6 layer")
+	}
+
+	return extractStackSignature(6, ip.HopLimit, false, tcp)
+}
+
+func extractStackSignature(version, ttl uint8, df bool, tcp *layers.TCP) (StackSignature, error) {
+	sig := StackSignature{WScale: -1}
+
+	if tcp == nil {
+		return sig, errors.New("missing TCP layer")
+	}
+	// like p0f, only client SYNs: SYN-ACKs carry the server's stack
+	if !tcp.SYN || tcp.ACK {
+		return sig, errors.New("not a SYN")
+	}
+
+	sig.Version = version
+	sig.TTL = ttl
+	sig.InitialTTL = initialTTL(ttl)
+	sig.DontFragment = df
+	sig.Window = tcp.Window
+
+	layout := make([]string, 0, len(tcp.Options))
+	for _, opt := range tcp.Options {
+		layout = append(layout, optionName(opt.OptionType))
+
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) >= 2 {
+				sig.MSS = uint16(opt.OptionData[0])<<8 | uint16(opt.OptionData[1])
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) >= 1 {
+				sig.WScale = int(opt.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			sig.SACKPermitted = true
+		case layers.TCPOptionKindTimestamps:
+			sig.Timestamps = true
+		}
+	}
+	sig.Options = strings.Join(layout, ",")
+
+	return sig, nil
+}
+
+// StackSignatureOf extracts the stack signature of a packet, see ExtractStackSignature
+func StackSignatureOf(packet gopacket.Packet) (StackSignature, error) {
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		return ExtractStackSignatureV6(ip, tcp)
+	}
+
+	ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	return ExtractStackSignature(ip, tcp)
+}
+
+// String returns the signature in a p0f-like "ver:ittl:df:mss:win,scale:layout" form
+func (sig StackSignature) String() string {
+	df := 0
+	if sig.DontFragment {
+		df = 1
+	}
+
+	scale := "*"
+	if sig.WScale >= 0 {
+		scale = fmt.Sprint(sig.WScale)
+	}
+
+	return fmt.Sprintf("%d:%d:%d:%d:%d,%s:%s", sig.Version, sig.InitialTTL, df, sig.MSS, sig.Window, scale, sig.Options)
+}
+
+// ID returns a short hash of the signature; the observed TTL is left out as
+// it depends on the path, not on the host
+func (sig StackSignature) ID() uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(sig.String()))
+	return h.Sum32()
+}
+
+// CompositeFingerprint combines the timestamp fingerprint with the stack
+// signature, telling apart hosts that booted in the same window but run
+// different stacks
+type CompositeFingerprint struct {
+	Fingerprint
+	Stack StackSignature
+}
+
+// String returns the haiku followed by the stack signature ID, e.g.
+// "billowing-violet-stupid/3fa2c1d0"
+func (cf CompositeFingerprint) String() string {
+	return fmt.Sprintf("%s/%08x", cf.Haiku(), cf.Stack.ID())
+}
@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"math"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// TSval frequencies seen in the wild: Linux (1000, 250, 300, 100), BSDs and
+// Windows (100, 10)
+var knownTickRates = []uint64{10, 100, 250, 300, 1000}
+
+const (
+	// Minimum capture time span (ms) between two packets of a clock to
+	// estimate the rate from them
+	minTickSpan = 1000
+	// Relative error allowed when snapping a measurement to a known rate
+	tickRateTolerance = 0.15
+	// Flows or sources tracked, the least recently seen are dropped beyond,
+	// keeps memory bounded
+	maxTickFlows = 1 << 16
+	// Clocks tracked per source, the least recently seen is dropped beyond
+	maxSourceClocks = 64
+	// Capture time jitter (ms) allowed when checking that a packet fits a clock
+	clockJitter = 100
+)
+
+type flowKey struct {
+	network, transport gopacket.Flow
+}
+
+type tickSample struct {
+	captureMillis uint64
+	tsVal         uint64
+}
+
+// since returns the capture time (ms) and TSval ticks elapsed from s to
+// later, signed differences keep out-of-order samples and TSval wrap-around
+// sane
+func (s tickSample) since(later tickSample) (int64, int64) {
+	return int64(later.captureMillis - s.captureMillis), int64(int32(uint32(later.tsVal) - uint32(s.tsVal)))
+}
+
+// tickClock is a TSval clock seen from a source. The packets of a host that
+// does not randomize its offsets all fit the same clock, whatever their flow,
+// while hosts behind the same NAT address have a clock each.
+type tickClock struct {
+	id          uint64
+	first, last tickSample
+	hz          uint64 // 0 until measured
+}
+
+// fits reports whether a sample can come from the clock: with a known rate
+// its TSval must be about where the rate predicts, otherwise it must have
+// advanced at a plausible rate since the last sample
+func (c *tickClock) fits(s tickSample) bool {
+	span, ticks := c.last.since(s)
+	if span < 0 {
+		span, ticks = -span, -ticks
+	}
+
+	if c.hz != 0 {
+		expected := float64(span) * float64(c.hz) / 1000
+		slack := 2 + float64(c.hz)*clockJitter/1000 + expected*tickRateTolerance
+		return math.Abs(float64(ticks)-expected) <= slack
+	}
+
+	fastest := float64(knownTickRates[len(knownTickRates)-1]) * (1 + tickRateTolerance)
+	return ticks >= -2 && float64(ticks) <= 2+fastest*float64(span+clockJitter)/1000
+}
+
+// snapTickRate returns the known rate closest to the measured one, or 0 if
+// none is within tolerance
+func snapTickRate(measured float64) uint64 {
+	var best uint64
+	bestErr := tickRateTolerance
+
+	for _, rate := range knownTickRates {
+		relErr := math.Abs(measured-float64(rate)) / float64(rate)
+		if relErr <= bestErr {
+			best, bestErr = rate, relErr
+		}
+	}
+
+	return best
+}
+
+// TickRateEstimator infers the TSval frequency of the hosts behind each
+// source, so that Deltas can be computed in milliseconds even for hosts that
+// do not tick at 1 kHz. Packets are grouped into clocks by the TSval they
+// carry rather than by flow, so hosts whose connections last less than
+// minTickSpan are measured across connections.
+type TickRateEstimator struct {
+	mu      sync.Mutex
+	sources *recentMap[string, []*tickClock] // most recently seen last
+	lastID  uint64
+}
+
+func NewTickRateEstimator() *TickRateEstimator {
+	return &TickRateEstimator{sources: newRecentMap[string, []*tickClock](maxTickFlows)}
+}
+
+// Observe records a packet of the source and returns the clock it belongs to
+// and its TSval rate in Hz, 0 if it is not known yet
+func (e *TickRateEstimator) Observe(source string, captureMillis, tsVal uint64) (uint64, uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sample := tickSample{captureMillis, tsVal}
+	clocks, _ := e.sources.get(source)
+
+	found := -1
+	for i := len(clocks) - 1; i >= 0; i-- {
+		if clocks[i].fits(sample) {
+			found = i
+			break
+		}
+	}
+
+	var clock *tickClock
+	if found >= 0 {
+		clock = clocks[found]
+		clocks = append(append(clocks[:found:found], clocks[found+1:]...), clock)
+	} else {
+		e.lastID++
+		clock = &tickClock{id: e.lastID, first: sample, last: sample}
+		clocks = append(clocks, clock)
+		if len(clocks) > maxSourceClocks {
+			clocks = clocks[1:]
+		}
+	}
+	e.sources.put(source, clocks)
+
+	if clock.hz == 0 {
+		span, ticks := clock.first.since(sample)
+		if span < 0 {
+			span, ticks = -span, -ticks
+		}
+		if span >= minTickSpan && ticks > 0 {
+			clock.hz = snapTickRate(float64(ticks) * 1000 / float64(span))
+		}
+	}
+
+	if sample.captureMillis > clock.last.captureMillis {
+		clock.last = sample
+	}
+
+	return clock.id, clock.hz
+}
+
+// Annotate feeds the packet to the estimator and records its TSval clock on
+// the fingerprint. Until the rate of the clock is measured the Delta assumes
+// 1 kHz, the Linux default, then it is recomputed with the TSval scaled to
+// milliseconds if the clock ticks at another rate.
+func (e *TickRateEstimator) Annotate(packet gopacket.Packet, fg *Fingerprint, captureMillis, tsVal uint64) {
+	if packet.NetworkLayer() == nil {
+		return
+	}
+
+	source := packet.NetworkLayer().NetworkFlow().Src().String()
+	fg.clock, fg.Hz = e.Observe(source, captureMillis, tsVal)
+	if fg.Hz != 0 && fg.Hz != 1000 {
+		fg.Delta = approx(captureMillis-tsVal*1000/fg.Hz, config.Precision)
+		fg.haiku = ""
+	}
+}
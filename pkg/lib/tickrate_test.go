@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testHost is a simulated host whose TSval ticks at hz since boot, with the
+// given clock skew and offset
+type testHost struct {
+	src    string
+	hz     float64
+	skew   float64 // ppm
+	boot   time.Time
+	offset uint32
+}
+
+func (h testHost) tsVal(sent time.Time) uint32 {
+	ms := float64(sent.Sub(h.boot).Microseconds()) / 1000 * (1 + h.skew/1e6)
+	return uint32(ms*h.hz/1000) + h.offset
+}
+
+// testBoot is not on a bucket boundary, so that the Deltas don't flip
+var testBoot = time.Date(2024, 1, 1, 9, 0, 3, 0, time.UTC)
+
+var testStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// testPacket builds a TCP packet from src:sport to the service carrying the
+// given TSval, captured at the given time
+func testPacket(t *testing.T, src string, sport uint16, capture time.Time, tsVal uint32) gopacket.Packet {
+	t.Helper()
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP("10.60.1.1")}
+	opt := make([]byte, 8)
+	binary.BigEndian.PutUint32(opt, tsVal)
+	binary.BigEndian.PutUint32(opt[4:], 1)
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: 1337, ACK: true, Window: 502,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: opt}}}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = capture
+	return packet
+}
+
+// testFlow runs a connection of the host through the annotator, a packet
+// every step for dur, and returns the fingerprints along with the ones the
+// packets get without estimators
+func testFlow(t *testing.T, a *Annotator, h testHost, sport uint16, start time.Time, dur, step time.Duration) ([]Fingerprint, []Fingerprint) {
+	t.Helper()
+
+	var fgs, plain []Fingerprint
+	for sent := start; sent.Before(start.Add(dur)); sent = sent.Add(step) {
+		packet := testPacket(t, h.src, sport, sent, h.tsVal(sent))
+		fg, millis, tsVal, err := ExtractFingerprint(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain = append(plain, fg)
+
+		a.Annotate(packet, &fg, millis, tsVal)
+		fgs = append(fgs, fg)
+	}
+	return fgs, plain
+}
+
+func TestTickRateShortConnection(t *testing.T) {
+	h := testHost{src: "10.60.3.2", hz: 1000, boot: testBoot}
+	fgs, plain := testFlow(t, NewAnnotator(), h, 40000, testStart, 300*time.Millisecond, 100*time.Millisecond)
+
+	for i, fg := range fgs {
+		if fg.Haiku() != plain[i].Haiku() {
+			t.Errorf("packet %d: got %s, want the 1 kHz fingerprint %s", i, fg.Haiku(), plain[i].Haiku())
+		}
+	}
+}
+
+func TestTickRateLongConnection(t *testing.T) {
+	h := testHost{src: "10.60.3.2", hz: 1000, boot: testBoot}
+	fgs, plain := testFlow(t, NewAnnotator(), h, 40000, testStart, 4*time.Second, 100*time.Millisecond)
+
+	if len(fgs) != 40 {
+		t.Fatalf("got %d fingerprints, want 40", len(fgs))
+	}
+	for i, fg := range fgs {
+		if fg.Haiku() != plain[0].Haiku() {
+			t.Errorf("packet %d: got %s, want %s", i, fg.Haiku(), plain[0].Haiku())
+		}
+	}
+	if last := fgs[len(fgs)-1]; last.Hz != 1000 {
+		t.Errorf("got %d Hz, want 1000", last.Hz)
+	}
+}
+
+func TestTickRateSlowHost(t *testing.T) {
+	a := NewAnnotator()
+	h := testHost{src: "10.60.4.2", hz: 100, boot: testBoot}
+	want := approx(uint64(h.boot.UnixMilli()), config.Precision)
+
+	// short connections, measured across each other
+	var fgs []Fingerprint
+	for i := 0; i < 10; i++ {
+		flow, _ := testFlow(t, a, h, uint16(40000+i), testStart.Add(time.Duration(i)*time.Second), 300*time.Millisecond, 100*time.Millisecond)
+		fgs = append(fgs, flow...)
+	}
+
+	measured := 0
+	for i, fg := range fgs {
+		if fg.Hz == 0 {
+			if measured > 0 {
+				t.Errorf("packet %d: rate forgotten", i)
+			}
+			continue
+		}
+		measured++
+		if fg.Hz != 100 || fg.Delta != want {
+			t.Errorf("packet %d: got %d Hz and Delta %d, want 100 Hz and Delta %d", i, fg.Hz, fg.Delta, want)
+		}
+	}
+	if measured < len(fgs)-6 {
+		t.Errorf("rate measured on %d packets out of %d", measured, len(fgs))
+	}
+
+	// a flood of new sources doesn't evict a host seen meanwhile
+	for i := 0; i < 2*maxTickFlows; i++ {
+		a.TickRate.Observe(fmt.Sprintf("fd00::%x", i), 0, 0)
+		if i%(maxTickFlows/4) == 0 {
+			testFlow(t, a, h, 41000, testStart.Add(time.Minute), 100*time.Millisecond, 100*time.Millisecond)
+		}
+	}
+	if n := len(a.TickRate.sources.cur) + len(a.TickRate.sources.prev); n > maxTickFlows {
+		t.Errorf("%d sources tracked, want at most %d", n, maxTickFlows)
+	}
+
+	fgs, _ = testFlow(t, a, h, 42000, testStart.Add(2*time.Minute), 100*time.Millisecond, 100*time.Millisecond)
+	if fgs[0].Hz != 100 || fgs[0].Delta != want {
+		t.Errorf("after the flood: got %d Hz and Delta %d, want 100 Hz and Delta %d", fgs[0].Hz, fgs[0].Delta, want)
+	}
+}